@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/antonerne/go-soap/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type apiKeyRequest struct {
+	Name        string   `json:"name" binding:"required"`
+	Scopes      []string `json:"scopes" binding:"required"`
+	ExpiresDays int      `json:"expires_days"`
+}
+
+type apiKeyResponse struct {
+	Key    string         `json:"key"`
+	APIKey *models.APIKey `json:"api_key"`
+}
+
+// GetAPIKeys function will provide the authorized user's API keys.
+func (ctl *Controller) GetAPIKeys(c *gin.Context) {
+	ctl.sendAPIKeys(c, ctl.userID(c))
+}
+
+// CreateAPIKey function will create an API key for the authorized user.  The
+// key is only given in this response, as only its hash is kept.
+func (ctl *Controller) CreateAPIKey(c *gin.Context) {
+	var req apiKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	key, encoded, errMsg := models.NewAPIKey(ctl.userID(c), req.Name,
+		req.Scopes, req.ExpiresDays)
+	if errMsg != nil {
+		ctl.sendError(c, errMsg)
+		return
+	}
+	var count int64
+	err := ctl.DB.Model(&models.APIKey{}).Where("userid = ?", key.UserID).
+		Count(&count).Error
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	if count >= int64(models.APIKeyLimit) {
+		ctl.sendError(c, &models.ErrorMessage{
+			ErrorType:  "api key",
+			StatusCode: http.StatusConflict,
+			Message: fmt.Sprintf("A user can have at most %d API keys",
+				models.APIKeyLimit),
+		})
+		return
+	}
+	if err = ctl.DB.Create(key).Error; err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("API Key Created: %s - %s (%s)", key.UserID,
+		key.Name, key.Scopes))
+	c.JSON(http.StatusCreated, apiKeyResponse{Key: encoded, APIKey: key})
+}
+
+// DeleteAPIKey function will revoke one of the authorized user's API keys.
+func (ctl *Controller) DeleteAPIKey(c *gin.Context) {
+	ctl.deleteAPIKey(c, ctl.userID(c), c.Param("id"))
+}
+
+// GetUserAPIKeys function will provide an editor with the API keys of any
+// account.
+func (ctl *Controller) GetUserAPIKeys(c *gin.Context) {
+	user, ok := ctl.loadUser(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	ctl.sendAPIKeys(c, user.ID)
+}
+
+func (ctl *Controller) DeleteUserAPIKey(c *gin.Context) {
+	user, ok := ctl.loadUser(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	ctl.deleteAPIKey(c, user.ID, c.Param("key"))
+}
+
+func (ctl *Controller) sendAPIKeys(c *gin.Context, userID string) {
+	var keys []models.APIKey
+	err := ctl.DB.Order("created").Find(&keys, "userid = ?", userID).Error
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+func (ctl *Controller) deleteAPIKey(c *gin.Context, userID string,
+	id string) {
+	var key models.APIKey
+	err := ctl.DB.First(&key, "id = ? AND userid = ?", id, userID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		ctl.notFound(c, "api key")
+		return
+	} else if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	if err = ctl.DB.Delete(&key).Error; err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	models.SessionKeys.Remove(key.ID)
+	ctl.Log.WriteToLog(fmt.Sprintf("API Key Revoked: %s - %s by %s", userID,
+		key.Name, ctl.userID(c)))
+	c.Status(http.StatusNoContent)
+}
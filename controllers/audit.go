@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/antonerne/go-soap/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// GetAuditLog function will provide a page of the audit log, newest first.
+// The log can be filtered by the action, the editor who made the change or
+// the user changed.
+func (ctl *Controller) GetAuditLog(c *gin.Context) {
+	query := ctl.DB.Model(&models.AuditEntry{})
+	for param, column := range map[string]string{
+		"action": "action", "actor": "actorid", "target": "targetid",
+	} {
+		if value := c.Query(param); value != "" {
+			query = query.Where(column+" = ?", value)
+		}
+	}
+	ctl.sendAuditLog(c, query)
+}
+
+// GetUserAuditLog function will provide a page of the changes made to a
+// user's account, newest first.
+func (ctl *Controller) GetUserAuditLog(c *gin.Context) {
+	ctl.sendAuditLog(c, ctl.DB.Model(&models.AuditEntry{}).
+		Where("targetid = ?", c.Param("id")))
+}
+
+func (ctl *Controller) sendAuditLog(c *gin.Context, query *gorm.DB) {
+	query, page, ok := ctl.paginate(c, query)
+	if !ok {
+		return
+	}
+	entries := make([]models.AuditEntry, 0)
+	err := query.Order("created DESC, id DESC").Find(&entries).Error
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	page.Items = entries
+	c.JSON(http.StatusOK, page)
+}
+
+// audited function will make the change to the user's account in a
+// transaction with the audit log entry recording it, so no change is made
+// without its entry.
+func (ctl *Controller) audited(c *gin.Context, target *models.User,
+	action string, details string, change func(tx *gorm.DB) error) error {
+	return ctl.DB.Transaction(func(tx *gorm.DB) error {
+		if err := change(tx); err != nil {
+			return err
+		}
+		return tx.Create(models.NewAuditEntry(ctl.userID(c), target, action,
+			details, c.ClientIP())).Error
+	})
+}
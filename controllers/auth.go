@@ -0,0 +1,382 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/antonerne/go-soap/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type loginRequest struct {
+	Email    string `json:"email" binding:"required"`
+	Password string `json:"password" binding:"required"`
+	OTP      string `json:"otp"`
+}
+
+// Login function will check the user's email and password, saving the
+// result of the attempt to the user's credentials.  A login from an unknown
+// remote address will start the new remote process instead of providing a
+// token, and users with two-factor authentication must also give a TOTP or
+// recovery code.
+func (ctl *Controller) Login(c *gin.Context) {
+	var req loginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	remote := c.ClientIP()
+
+	user, ok := ctl.findUserByEmail(c, req.Email)
+	if !ok {
+		return
+	}
+
+	lockCount := user.Creds.LockCount
+	ok, errMsg := user.Creds.LogIn(req.Password, remote)
+	err := ctl.saveAttempt(user, lockCount)
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	if !ok {
+		ctl.Log.WriteToLog(fmt.Sprintf("Login Failure: %s from %s - %s",
+			user.Email, remote, errMsg.String()))
+		ctl.sendError(c, errMsg)
+		return
+	}
+	if errMsg != nil {
+		code := user.Creds.StartRemoteToken(remote)
+		err = ctl.saveCreds(&user.Creds, "newremotetoken", "newremoteip",
+			"newremoteexpires")
+		if err != nil {
+			ctl.databaseError(c, err)
+			return
+		}
+		err = ctl.Notifier.SendRemoteCode(user, code, remote,
+			user.Creds.NewRemoteExpires)
+		if err != nil {
+			ctl.Log.WriteToLog(fmt.Sprintf("Remote Code Not Sent: %s - %s",
+				user.Email, err.Error()))
+		}
+		ctl.Log.WriteToLog(fmt.Sprintf("Login New Remote: %s from %s",
+			user.Email, remote))
+		c.JSON(int(errMsg.StatusCode), errMsg)
+		return
+	}
+	if !ctl.checkSecondFactor(c, user, req.OTP) {
+		return
+	}
+	if device := user.Creds.TouchRemote(remote); device != nil {
+		err = ctl.DB.Model(device).Update("lastseen", device.LastSeen).Error
+		if err != nil {
+			ctl.databaseError(c, err)
+			return
+		}
+	}
+	// a journal key that can't be opened only keeps the journal locked, so
+	// the user can still sign in.
+	journal, err := ctl.openJournal(&user.Creds, req.Password)
+	if err != nil {
+		ctl.Log.WriteToLog(fmt.Sprintf("Journal Key Failure: %s - %s",
+			user.Email, err.Error()))
+	}
+
+	ctl.startSession(c, user, journal)
+}
+
+// Logout function will remove the request's token from the database, along
+// with the other tokens in its refresh family, so none of them will be
+// authorized again.
+func (ctl *Controller) Logout(c *gin.Context) {
+	var token models.Token
+	err := ctl.DB.Find(&token, "id = ?", ctl.tokenID(c)).Error
+	if err == nil {
+		if token.FamilyID != "" {
+			err = ctl.revokeFamily(token.FamilyID)
+		} else {
+			err = ctl.DB.Delete(&token).Error
+		}
+	}
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Logout: %s", ctl.userID(c)))
+	c.Status(http.StatusNoContent)
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// Refresh function will exchange a refresh token for a new access token and
+// a new refresh token.  A refresh token can only be used once, so a replayed
+// token means it was stolen and the whole family is revoked.
+func (ctl *Controller) Refresh(c *gin.Context) {
+	var req refreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	refreshFailure := &models.ErrorMessage{
+		ErrorType:  "refresh",
+		StatusCode: http.StatusUnauthorized,
+		Message:    "invalid refresh token",
+	}
+
+	id, secret, err := models.ParseRefreshToken(req.RefreshToken)
+	if err != nil {
+		ctl.sendError(c, refreshFailure)
+		return
+	}
+	var rt models.RefreshToken
+	err = ctl.DB.First(&rt, "id = ?", id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) ||
+		(err == nil && !rt.Matches(secret)) {
+		ctl.sendError(c, refreshFailure)
+		return
+	} else if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+
+	// mark the token used only if no other request has, so two requests
+	// racing with the same token can't both succeed.
+	result := ctl.DB.Model(&models.RefreshToken{}).
+		Where("id = ? AND used = ? AND revoked = ?", rt.ID, false, false).
+		Update("used", true)
+	if result.Error != nil {
+		ctl.databaseError(c, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		ctl.Log.WriteToLog(fmt.Sprintf("Refresh Token Reuse: user %s from %s",
+			rt.UserID, c.ClientIP()))
+		if err = ctl.revokeFamily(rt.FamilyID); err != nil {
+			ctl.databaseError(c, err)
+			return
+		}
+		ctl.sendError(c, refreshFailure)
+		return
+	}
+	if rt.Expires.Before(time.Now()) {
+		ctl.sendError(c, refreshFailure)
+		return
+	}
+
+	var user models.User
+	err = ctl.DB.Preload("Name").Preload("Creds").Preload("Roles").
+		First(&user, "id = ?", rt.UserID).Error
+	if err == nil && user.Creds.IsLocked() {
+		err = errors.New("account locked")
+	}
+	if err != nil {
+		ctl.Log.WriteToLog(fmt.Sprintf("Refresh Failure: user %s - %s",
+			rt.UserID, err.Error()))
+		ctl.revokeFamily(rt.FamilyID)
+		ctl.sendError(c, refreshFailure)
+		return
+	}
+	ctl.issueTokens(c, &user, rt.FamilyID, nil)
+}
+
+// startSession function will start a new refresh family for the user and
+// send the user's first tokens to the client.  The journal key, when the
+// sign in gave the password, is kept for the new session.
+func (ctl *Controller) startSession(c *gin.Context, user *models.User,
+	journal *journalKeys) {
+	ctl.Log.WriteToLog(fmt.Sprintf("Login: %s from %s", user.Email,
+		c.ClientIP()))
+	ctl.issueTokens(c, user, "", journal)
+}
+
+// issueTokens function will create the user's access and refresh tokens in
+// the family, store them in the database and send them to the client.  A
+// new session also tells the user of a new recovery key, or warns them when
+// their journal has none.
+func (ctl *Controller) issueTokens(c *gin.Context, user *models.User,
+	family string, journal *journalKeys) {
+	tokenFailure := &models.ErrorMessage{
+		ErrorType:  "token",
+		StatusCode: http.StatusInternalServerError,
+		Message:    "token creation failure",
+	}
+	signed, token, err := user.Creds.CreateJWTToken(user.ID, user.Email,
+		user.RoleNames())
+	if err != nil {
+		ctl.Log.WriteToLog(err.Error())
+		ctl.sendError(c, tokenFailure)
+		return
+	}
+	refresh, encoded, err := models.NewRefreshToken(user.ID, family)
+	if err != nil {
+		ctl.Log.WriteToLog(err.Error())
+		ctl.sendError(c, tokenFailure)
+		return
+	}
+	token.FamilyID = refresh.FamilyID
+	token.RemoteIP = c.ClientIP()
+	token.UserAgent = c.Request.UserAgent()
+	err = ctl.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(token).Error; err != nil {
+			return err
+		}
+		return tx.Create(refresh).Error
+	})
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	response := models.LoginResponse{
+		Token:        signed,
+		RefreshToken: encoded,
+	}
+	if journal != nil {
+		models.SessionKeys.Put(refresh.FamilyID, user.ID, journal.key)
+		response.RecoveryKey = journal.recovery
+	}
+	if family == "" {
+		response.Warnings = journalStatus(&user.Creds, journal != nil,
+			response.RecoveryKey).Warnings
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// revokeFamily function will revoke every refresh token in the family and
+// remove the access tokens issued with them, locking the session's journal.
+func (ctl *Controller) revokeFamily(family string) error {
+	models.SessionKeys.Remove(family)
+	return ctl.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.RefreshToken{}).
+			Where("familyid = ?", family).Update("revoked", true).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(&models.Token{}, "familyid = ?", family).Error
+	})
+}
+
+// revokeSessions function will revoke every refresh token for the user and
+// remove all the user's access tokens and API keys.
+func (ctl *Controller) revokeSessions(userID string) error {
+	return ctl.DB.Transaction(func(tx *gorm.DB) error {
+		if err := revokeTokens(tx, userID); err != nil {
+			return err
+		}
+		return tx.Delete(&models.APIKey{}, "userid = ?", userID).Error
+	})
+}
+
+func revokeTokens(tx *gorm.DB, userID string) error {
+	models.SessionKeys.RemoveUser(userID)
+	err := tx.Model(&models.RefreshToken{}).
+		Where("userid = ?", userID).Update("revoked", true).Error
+	if err != nil {
+		return err
+	}
+	return tx.Delete(&models.Token{}, "userid = ?", userID).Error
+}
+
+// findUserByEmail function will load the user and credentials for the email
+// address.  An unknown address is reported as an authorization failure so
+// the response won't show which addresses have accounts.
+func (ctl *Controller) findUserByEmail(c *gin.Context,
+	email string) (*models.User, bool) {
+	user, err := ctl.lookupUser(email)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		ctl.Log.WriteToLog(fmt.Sprintf("Unknown Email: %s from %s", email,
+			c.ClientIP()))
+		ctl.sendError(c, &models.ErrorMessage{
+			ErrorType:  "credentials",
+			StatusCode: http.StatusUnauthorized,
+			Message:    "authorization failure",
+		})
+		return nil, false
+	} else if err != nil {
+		ctl.databaseError(c, err)
+		return nil, false
+	}
+	return user, true
+}
+
+func (ctl *Controller) lookupUser(email string) (*models.User, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	return ctl.loginUser("LOWER(email) = ?", email)
+}
+
+// loginUser function will load the user matching the query with everything
+// the log in checks need.
+func (ctl *Controller) loginUser(query string, arg string) (*models.User,
+	error) {
+	var user models.User
+	err := ctl.DB.Preload("Name").Preload("Creds.Remotes").
+		Preload("Creds.History").Preload("Creds.RecoveryCodes").
+		Preload("Creds.Passkeys").Preload("Roles").
+		First(&user, query, arg).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// saveCreds function will save the credentials' fields given.
+func (ctl *Controller) saveCreds(creds *models.Credentials,
+	fields ...string) error {
+	return ctl.DB.Model(creds).Select(fields).Updates(creds).Error
+}
+
+// saveAttempt function will save the result of a log in attempt, with the
+// other credentials' fields given, telling the user if the attempt locked
+// their account.
+func (ctl *Controller) saveAttempt(user *models.User, lockCount int16,
+	fields ...string) error {
+	fields = append(fields, "badattempts", "locked", "lockeduntil",
+		"lockcount")
+	if err := ctl.saveCreds(&user.Creds, fields...); err != nil {
+		return err
+	}
+	if user.Creds.LockCount > lockCount {
+		ctl.Log.WriteToLog(fmt.Sprintf("Account Locked: %s until %s",
+			user.Email, user.Creds.LockedUntil.Format(time.RFC3339)))
+		err := ctl.Notifier.SendLocked(user, user.Creds.LockedUntil)
+		if err != nil {
+			ctl.Log.WriteToLog(fmt.Sprintf("Lock Notice Not Sent: %s - %s",
+				user.Email, err.Error()))
+		}
+	}
+	return nil
+}
+
+// savePassword function will save the credentials' password and the other
+// fields given, along with the password history, removing the previous
+// passwords the policy no longer keeps.
+func (ctl *Controller) savePassword(creds *models.Credentials,
+	fields ...string) error {
+	fields = append(fields, "password", "expires", "mustchange",
+		"badattempts", "locked")
+	return ctl.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(creds).Select(fields).Updates(creds).Error
+		if err != nil {
+			return err
+		}
+		keep := make([]uint64, 0)
+		for i := range creds.History {
+			if creds.History[i].ID == 0 {
+				if err = tx.Create(&creds.History[i]).Error; err != nil {
+					return err
+				}
+			}
+			keep = append(keep, creds.History[i].ID)
+		}
+		query := tx.Where("userid = ?", creds.UserID)
+		if len(keep) > 0 {
+			query = query.Where("id NOT IN ?", keep)
+		}
+		return query.Delete(&models.PasswordHistory{}).Error
+	})
+}
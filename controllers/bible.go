@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/antonerne/go-soap/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// GetBibleBooks function will provide the list of bible books in canonical
+// order.
+func (ctl *Controller) GetBibleBooks(c *gin.Context) {
+	var books []models.BibleBook
+	if err := ctl.DB.Find(&books).Error; err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	sort.Sort(models.ByBibleBooks(books))
+	c.JSON(http.StatusOK, books)
+}
+
+func (ctl *Controller) GetBibleBook(c *gin.Context) {
+	id, ok := ctl.paramID(c, "id")
+	if !ok {
+		return
+	}
+	var book models.BibleBook
+	err := ctl.DB.First(&book, "id = ?", id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		ctl.notFound(c, "bible book")
+		return
+	} else if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, book)
+}
+
+// GetBibleStudies function will provide the list of the available bible
+// studies, without their periods.
+func (ctl *Controller) GetBibleStudies(c *gin.Context) {
+	var studies []models.BibleStudy
+	if err := ctl.DB.Find(&studies).Error; err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	sort.Sort(models.ByBibleStudy(studies))
+	c.JSON(http.StatusOK, studies)
+}
+
+// GetBibleStudy function will provide a single bible study with all its
+// periods, days and references in order.
+func (ctl *Controller) GetBibleStudy(c *gin.Context) {
+	study, ok := ctl.paramStudy(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, study)
+}
+
+func (ctl *Controller) CreateBibleStudy(c *gin.Context) {
+	var study models.BibleStudy
+	if err := c.ShouldBindJSON(&study); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	study.ID = 0
+	if err := ctl.DB.Create(&study).Error; err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog("Bible Study Created: " + study.Title)
+	c.JSON(http.StatusCreated, study)
+}
+
+// UpdateBibleStudy function will update the study's title, length and start
+// option.  The study's periods are not changed.
+func (ctl *Controller) UpdateBibleStudy(c *gin.Context) {
+	study, ok := ctl.paramStudy(c)
+	if !ok {
+		return
+	}
+	var update models.BibleStudy
+	if err := c.ShouldBindJSON(&update); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	study.Title = update.Title
+	study.Days = update.Days
+	study.BeginImmediately = update.BeginImmediately
+	err := ctl.DB.Model(study).Select("title", "days", "begin").
+		Updates(study).Error
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, study)
+}
+
+func (ctl *Controller) DeleteBibleStudy(c *gin.Context) {
+	study, ok := ctl.paramStudy(c)
+	if !ok {
+		return
+	}
+	if err := ctl.DB.Delete(study).Error; err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog("Bible Study Deleted: " + study.Title)
+	c.Status(http.StatusNoContent)
+}
+
+func (ctl *Controller) paramStudy(c *gin.Context) (*models.BibleStudy, bool) {
+	id, ok := ctl.paramID(c, "id")
+	if !ok {
+		return nil, false
+	}
+	return ctl.loadBibleStudy(c, id)
+}
+
+func (ctl *Controller) loadBibleStudy(c *gin.Context,
+	id uint64) (*models.BibleStudy, bool) {
+	var study models.BibleStudy
+	err := ctl.DB.Preload("Periods.StudyDays.References").
+		First(&study, "id = ?", id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		ctl.notFound(c, "bible study")
+		return nil, false
+	} else if err != nil {
+		ctl.databaseError(c, err)
+		return nil, false
+	}
+	sort.Sort(models.ByBibleStudyPeriod(study.Periods))
+	for _, period := range study.Periods {
+		sort.Sort(models.ByBibleStudyDay(period.StudyDays))
+		for _, day := range period.StudyDays {
+			sort.Sort(models.ByBibleStudyDayReference(day.References))
+		}
+	}
+	return &study, true
+}
@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/antonerne/go-soap/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Controller holds the shared services used by the API handlers, so each
+// handler can reach the database, the log file and the user notifier.
+type Controller struct {
+	DB       *gorm.DB
+	Log      *models.LogFile
+	Notifier models.Notifier
+}
+
+func NewController(db *gorm.DB, log *models.LogFile,
+	notifier models.Notifier) *Controller {
+	return &Controller{
+		DB:       db,
+		Log:      log,
+		Notifier: notifier,
+	}
+}
+
+// userID function will provide the identifier of the user that was
+// authorized by the middleware for this request.
+func (ctl *Controller) userID(c *gin.Context) string {
+	if identity, ok := models.GetIdentity(c); ok {
+		return identity.UserID
+	}
+	return ""
+}
+
+// tokenID function will provide the identifier of the token used to
+// authorize this request.
+func (ctl *Controller) tokenID(c *gin.Context) string {
+	if identity, ok := models.GetIdentity(c); ok {
+		return identity.TokenID
+	}
+	return ""
+}
+
+// sendError function will stop the handler chain and send the error message
+// to the client with the message's status code.
+func (ctl *Controller) sendError(c *gin.Context, errMsg *models.ErrorMessage) {
+	c.AbortWithStatusJSON(int(errMsg.StatusCode), errMsg)
+}
+
+func (ctl *Controller) badRequest(c *gin.Context, err error) {
+	ctl.sendError(c, &models.ErrorMessage{
+		ErrorType:  "request",
+		StatusCode: http.StatusBadRequest,
+		Message:    err.Error(),
+	})
+}
+
+func (ctl *Controller) notFound(c *gin.Context, item string) {
+	ctl.sendError(c, &models.ErrorMessage{
+		ErrorType:  "not found",
+		StatusCode: http.StatusNotFound,
+		Message:    item + " not found",
+	})
+}
+
+// databaseError function will log the database error and send a generic
+// message to the client.
+func (ctl *Controller) databaseError(c *gin.Context, err error) {
+	ctl.Log.WriteToLog(err.Error())
+	ctl.sendError(c, &models.ErrorMessage{
+		ErrorType:  "database",
+		StatusCode: http.StatusInternalServerError,
+		Message:    "database error",
+	})
+}
+
+// paramID function will parse a numeric identifier from the request path,
+// sending a bad request response when it isn't a number.
+func (ctl *Controller) paramID(c *gin.Context, name string) (uint64, bool) {
+	id, err := strconv.ParseUint(c.Param(name), 10, 64)
+	if err != nil {
+		ctl.badRequest(c, err)
+		return 0, false
+	}
+	return id, true
+}
+
+// pageResponse is one page of a list, with the total number of items in the
+// list.
+type pageResponse struct {
+	Items   interface{} `json:"items"`
+	Page    int         `json:"page"`
+	PerPage int         `json:"per_page"`
+	Total   int64       `json:"total"`
+}
+
+// paginate function will read the page and per_page query parameters, which
+// default to the first page of 25 items, and apply them to the query.  At
+// most 100 items are given in a page.
+func (ctl *Controller) paginate(c *gin.Context,
+	query *gorm.DB) (*gorm.DB, pageResponse, bool) {
+	page := pageResponse{Page: 1, PerPage: 25}
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{{"page", &page.Page}, {"per_page", &page.PerPage}} {
+		if text := c.Query(param.name); text != "" {
+			value, err := strconv.Atoi(text)
+			if err != nil || value < 1 {
+				ctl.badRequest(c, fmt.Errorf("invalid %s", param.name))
+				return nil, page, false
+			}
+			*param.value = value
+		}
+	}
+	if page.PerPage > 100 {
+		page.PerPage = 100
+	}
+	err := query.Session(&gorm.Session{}).Count(&page.Total).Error
+	if err != nil {
+		ctl.databaseError(c, err)
+		return nil, page, false
+	}
+	return query.Offset((page.Page - 1) * page.PerPage).Limit(page.PerPage),
+		page, true
+}
@@ -0,0 +1,140 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/antonerne/go-soap/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type remoteRequest struct {
+	Email string `json:"email" binding:"required"`
+	Code  string `json:"code" binding:"required"`
+	Label string `json:"label"`
+	OTP   string `json:"otp"`
+}
+
+// VerifyRemote function will complete a login from a new remote address with
+// the code sent to the user, adding the address to the user's trusted
+// devices and providing the user's tokens.  Users with two-factor
+// authentication must also give a TOTP or recovery code, which is checked
+// after the device code.
+func (ctl *Controller) VerifyRemote(c *gin.Context) {
+	var req remoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	remote := c.ClientIP()
+
+	user, ok := ctl.findUserByEmail(c, req.Email)
+	if !ok {
+		return
+	}
+	lockCount := user.Creds.LockCount
+	ok, errMsg := user.VerifyRemoteToken(req.Code, remote)
+	if !ok {
+		err := ctl.saveAttempt(user, lockCount, "newremotetoken")
+		if err != nil {
+			ctl.databaseError(c, err)
+			return
+		}
+		ctl.Log.WriteToLog(fmt.Sprintf("Remote Code Failure: %s from %s",
+			user.Email, remote))
+		ctl.sendError(c, errMsg)
+		return
+	}
+	// the device code is only used up once the second factor is given too,
+	// so a mistyped TOTP code doesn't need a new device code.
+	if !ctl.checkSecondFactor(c, user, req.OTP) {
+		return
+	}
+	err := ctl.saveAttempt(user, lockCount, "newremotetoken", "newremoteip",
+		"newremoteexpires")
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+
+	device := user.Creds.AddRemote(remote, req.Label, c.Request.UserAgent())
+	if err = ctl.DB.Create(device).Error; err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Remote Approved: %s from %s (%s)",
+		user.Email, remote, device.Label))
+	ctl.startSession(c, user, nil)
+}
+
+// GetDevices function will provide the authorized user's trusted devices.
+func (ctl *Controller) GetDevices(c *gin.Context) {
+	var devices []models.UserRemote
+	err := ctl.DB.Order("lastseen desc").
+		Find(&devices, "userid = ?", ctl.userID(c)).Error
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, devices)
+}
+
+type deviceRequest struct {
+	Label string `json:"label" binding:"required"`
+}
+
+// UpdateDevice function will change the label of one of the authorized
+// user's trusted devices.
+func (ctl *Controller) UpdateDevice(c *gin.Context) {
+	var req deviceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	device, ok := ctl.paramDevice(c)
+	if !ok {
+		return
+	}
+	device.Label = req.Label
+	if err := ctl.DB.Model(device).Update("label", device.Label).Error; err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, device)
+}
+
+// DeleteDevice function will remove one of the authorized user's trusted
+// devices, so the next login from it will need a new approval code.
+func (ctl *Controller) DeleteDevice(c *gin.Context) {
+	device, ok := ctl.paramDevice(c)
+	if !ok {
+		return
+	}
+	if err := ctl.DB.Delete(device).Error; err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Remote Removed: %s - %s", ctl.userID(c),
+		device.RemoteIP))
+	c.Status(http.StatusNoContent)
+}
+
+func (ctl *Controller) paramDevice(c *gin.Context) (*models.UserRemote, bool) {
+	id, ok := ctl.paramID(c, "id")
+	if !ok {
+		return nil, false
+	}
+	var device models.UserRemote
+	err := ctl.DB.First(&device, "id = ? AND userid = ?", id,
+		ctl.userID(c)).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		ctl.notFound(c, "device")
+		return nil, false
+	} else if err != nil {
+		ctl.databaseError(c, err)
+		return nil, false
+	}
+	return &device, true
+}
@@ -0,0 +1,254 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/antonerne/go-soap/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// GetEntries function will provide the authorized user's journal entries
+// between the from and to dates, given as YYYY-MM-DD.  Without dates the
+// entries of the last 31 days are given.
+func (ctl *Controller) GetEntries(c *gin.Context) {
+	to := time.Now()
+	from := to.AddDate(0, 0, -31)
+	for _, param := range []struct {
+		name  string
+		value *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if text := c.Query(param.name); text != "" {
+			date, err := time.Parse("2006-01-02", text)
+			if err != nil {
+				ctl.badRequest(c, fmt.Errorf("%s must be given as YYYY-MM-DD",
+					param.name))
+				return
+			}
+			*param.value = date
+		}
+	}
+	from = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0,
+		time.UTC)
+	to = time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC).
+		AddDate(0, 0, 1)
+	userkey, ok := ctl.userKey(c)
+	if !ok {
+		return
+	}
+	entries := make([]models.Entry, 0)
+	err := ctl.DB.Preload("Reference").Preload("Texts").
+		Where("user_id = ? AND entrydate >= ? AND entrydate < ?",
+			ctl.userID(c), from, to).
+		Order("entrydate, id").Find(&entries).Error
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	for i := range entries {
+		if err = entries[i].ListTexts(userkey); err != nil {
+			ctl.encryptionError(c, err)
+			return
+		}
+		entries[i].SortTexts()
+	}
+	c.JSON(http.StatusOK, entries)
+}
+
+// GetEntry function will provide one of the authorized user's journal
+// entries.
+func (ctl *Controller) GetEntry(c *gin.Context) {
+	entry, ok := ctl.paramEntry(c)
+	if !ok {
+		return
+	}
+	userkey, ok := ctl.userKey(c)
+	if !ok || !ctl.decryptEntry(c, entry, userkey) {
+		return
+	}
+	c.JSON(http.StatusOK, entry)
+}
+
+// GetEntryDocument function will provide one of the authorized user's
+// journal entries laid out by its Scripture, Observation, Application and
+// Prayer sections, with its custom sections after them.
+func (ctl *Controller) GetEntryDocument(c *gin.Context) {
+	entry, ok := ctl.paramEntry(c)
+	if !ok {
+		return
+	}
+	userkey, ok := ctl.userKey(c)
+	if !ok || !ctl.decryptEntry(c, entry, userkey) {
+		return
+	}
+	doc, errMsg := entry.Document()
+	if errMsg != nil {
+		ctl.sendError(c, errMsg)
+		return
+	}
+	c.JSON(http.StatusOK, doc)
+}
+
+// CreateEntry function will create a journal entry for the authorized user,
+// with a new entry key sealed by the user's key.
+func (ctl *Controller) CreateEntry(c *gin.Context) {
+	var req models.EntryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	date, errMsg := req.Validate()
+	if errMsg != nil {
+		ctl.sendError(c, errMsg)
+		return
+	}
+	userkey, ok := ctl.userKey(c)
+	if !ok {
+		return
+	}
+	entry, err := models.NewEntry(ctl.userID(c), userkey, date)
+	if err == nil {
+		err = req.Apply(entry, date, userkey)
+	}
+	if err != nil {
+		ctl.encryptionError(c, err)
+		return
+	}
+	if err = ctl.DB.Create(entry).Error; err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	if ctl.decryptEntry(c, entry, userkey) {
+		c.JSON(http.StatusCreated, entry)
+	}
+}
+
+// UpdateEntry function will replace the date, title, references and texts
+// of one of the authorized user's journal entries.
+func (ctl *Controller) UpdateEntry(c *gin.Context) {
+	var req models.EntryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	date, errMsg := req.Validate()
+	if errMsg != nil {
+		ctl.sendError(c, errMsg)
+		return
+	}
+	entry, ok := ctl.paramEntry(c)
+	if !ok {
+		return
+	}
+	userkey, ok := ctl.userKey(c)
+	if !ok {
+		return
+	}
+	if err := req.Apply(entry, date, userkey); err != nil {
+		ctl.encryptionError(c, err)
+		return
+	}
+	err := ctl.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(entry).Select("entrydate", "title").
+			Updates(entry).Error
+		if err == nil {
+			err = tx.Delete(&models.EntryReference{}, "entry_id = ?",
+				entry.ID).Error
+		}
+		if err == nil {
+			err = tx.Delete(&models.EntryText{}, "entry_id = ?",
+				entry.ID).Error
+		}
+		if err == nil && len(entry.Reference) > 0 {
+			err = tx.Create(&entry.Reference).Error
+		}
+		if err == nil && len(entry.Texts) > 0 {
+			err = tx.Create(&entry.Texts).Error
+		}
+		return err
+	})
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	if ctl.decryptEntry(c, entry, userkey) {
+		c.JSON(http.StatusOK, entry)
+	}
+}
+
+// DeleteEntry function will remove one of the authorized user's journal
+// entries.
+func (ctl *Controller) DeleteEntry(c *gin.Context) {
+	entry, ok := ctl.paramEntry(c)
+	if !ok {
+		return
+	}
+	if err := ctl.DB.Delete(entry).Error; err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// paramEntry function will load the authorized user's entry from the request
+// path.  Other users' entries are reported as not found.
+func (ctl *Controller) paramEntry(c *gin.Context) (*models.Entry, bool) {
+	var entry models.Entry
+	err := ctl.DB.Preload("Reference").Preload("Texts").
+		First(&entry, "id = ? AND user_id = ?", c.Param("id"),
+			ctl.userID(c)).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		ctl.notFound(c, "entry")
+		return nil, false
+	} else if err != nil {
+		ctl.databaseError(c, err)
+		return nil, false
+	}
+	return &entry, true
+}
+
+// userKey function will provide the authorized user's journal key, which
+// seals their entry keys, as unlocked for the request's session.
+func (ctl *Controller) userKey(c *gin.Context) ([]byte, bool) {
+	identity, ok := models.GetIdentity(c)
+	if ok {
+		var key []byte
+		if key, ok = models.SessionKeys.Get(identity.SessionID,
+			identity.UserID); ok {
+			return key, true
+		}
+	}
+	ctl.sendError(c, models.JournalLocked())
+	return nil, false
+}
+
+func (ctl *Controller) decryptEntry(c *gin.Context, entry *models.Entry,
+	userkey []byte) bool {
+	if err := entry.DecryptTexts(userkey); err != nil {
+		ctl.encryptionError(c, err)
+		return false
+	}
+	entry.SortTexts()
+	return true
+}
+
+func (ctl *Controller) encryptionError(c *gin.Context, err error) {
+	ctl.Log.WriteToLog(fmt.Sprintf("Entry Encryption Failure: %s - %s",
+		ctl.userID(c), err.Error()))
+	if errors.Is(err, models.ErrWrongKey) {
+		ctl.sendError(c, &models.ErrorMessage{
+			ErrorType:  "entry",
+			StatusCode: http.StatusConflict,
+			Message:    "Entry was sealed with a previous journal key",
+		})
+		return
+	}
+	ctl.sendError(c, &models.ErrorMessage{
+		ErrorType:  "entry",
+		StatusCode: http.StatusInternalServerError,
+		Message:    "entry encryption failure",
+	})
+}
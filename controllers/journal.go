@@ -0,0 +1,233 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/antonerne/go-soap/models"
+	"github.com/gin-gonic/gin"
+)
+
+// journalKeys is the user's journal key unwrapped with their password, with
+// the recovery key when it was just created and must be shown to the user.
+type journalKeys struct {
+	key      []byte
+	recovery string
+}
+
+type journalResponse struct {
+	Unlocked    bool     `json:"unlocked"`
+	Recovery    bool     `json:"recovery"`
+	RecoveryKey string   `json:"recovery_key,omitempty"`
+	Warnings    []string `json:"warnings,omitempty"`
+}
+
+type journalPasswordRequest struct {
+	Password    string `json:"password"`
+	RecoveryKey string `json:"recovery_key"`
+}
+
+// GetJournal function will report if the authorized user's journal is
+// unlocked for the session and if it has a recovery key.
+func (ctl *Controller) GetJournal(c *gin.Context) {
+	identity, _ := models.GetIdentity(c)
+	var creds models.Credentials
+	err := ctl.DB.First(&creds, "userid = ?", identity.UserID).Error
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	_, unlocked := models.SessionKeys.Get(identity.SessionID, identity.UserID)
+	c.JSON(http.StatusOK, journalStatus(&creds, unlocked, ""))
+}
+
+// UnlockJournal function will unwrap the authorized user's journal key with
+// their password, keeping it for the session so their entries can be read
+// and written.  Sessions started without the password, like passkey and
+// identity provider sign ins and API keys, must unlock the journal this way.
+// Users without a password, created by the identity provider, give their
+// recovery key instead.
+func (ctl *Controller) UnlockJournal(c *gin.Context) {
+	identity, creds, ok := ctl.journalCredentials(c, "Unlock")
+	if !ok {
+		return
+	}
+	models.SessionKeys.Put(identity.SessionID, identity.UserID, creds.key)
+	ctl.Log.WriteToLog(fmt.Sprintf("Journal Unlocked: %s", identity.UserID))
+	c.JSON(http.StatusOK, journalStatus(creds.Credentials, true,
+		creds.recovery))
+}
+
+// LockJournal function will forget the authorized user's journal key for
+// the session, before it would expire.
+func (ctl *Controller) LockJournal(c *gin.Context) {
+	identity, _ := models.GetIdentity(c)
+	models.SessionKeys.Remove(identity.SessionID)
+	c.Status(http.StatusNoContent)
+}
+
+// CreateRecoveryKey function will give the authorized user a new recovery
+// key for their journal, after checking their password or recovery key.  Any earlier
+// recovery key no longer works.  The key is only given in this response.
+func (ctl *Controller) CreateRecoveryKey(c *gin.Context) {
+	identity, creds, ok := ctl.journalCredentials(c, "Recovery Key")
+	if !ok {
+		return
+	}
+	recovery := creds.recovery
+	if recovery == "" {
+		var err error
+		if recovery, err = creds.NewRecoveryKey(creds.key); err != nil {
+			ctl.journalError(c, err)
+			return
+		}
+		if err = ctl.saveCreds(creds.Credentials, "journalrecovery"); err != nil {
+			ctl.databaseError(c, err)
+			return
+		}
+	}
+	models.SessionKeys.Put(identity.SessionID, identity.UserID, creds.key)
+	ctl.Log.WriteToLog(fmt.Sprintf("Journal Recovery Key Created: %s",
+		identity.UserID))
+	c.JSON(http.StatusCreated, journalStatus(creds.Credentials, true,
+		recovery))
+}
+
+type unlockedCredentials struct {
+	*models.Credentials
+	*journalKeys
+}
+
+// journalCredentials function will check the password in the request
+// against the authorized user's and open their journal with it, or open the
+// journal with the recovery key in the request.  Wrong passwords and
+// recovery keys count as bad attempts, as at log in.
+func (ctl *Controller) journalCredentials(c *gin.Context,
+	action string) (*models.Identity, *unlockedCredentials, bool) {
+	var req journalPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return nil, nil, false
+	}
+	if req.Password == "" && req.RecoveryKey == "" {
+		ctl.badRequest(c, errors.New("password or recovery_key is required"))
+		return nil, nil, false
+	}
+	identity, _ := models.GetIdentity(c)
+	user, err := ctl.loginUser("id = ?", identity.UserID)
+	if err != nil {
+		ctl.databaseError(c, err)
+		return nil, nil, false
+	}
+	creds := &user.Creds
+	if req.Password == "" {
+		lockCount := creds.LockCount
+		key, errMsg := creds.RecoverJournalAttempt(req.RecoveryKey)
+		if err = ctl.saveAttempt(user, lockCount); err != nil {
+			ctl.databaseError(c, err)
+			return nil, nil, false
+		}
+		if errMsg != nil {
+			ctl.Log.WriteToLog(fmt.Sprintf("Journal %s Failure: %s from %s - %s",
+				action, user.Email, c.ClientIP(), errMsg.String()))
+			ctl.sendError(c, errMsg)
+			return nil, nil, false
+		}
+		return identity, &unlockedCredentials{creds,
+			&journalKeys{key: key}}, true
+	}
+	if !ctl.checkCurrentPassword(c, user, req.Password, "Journal "+action) {
+		return nil, nil, false
+	}
+	keys, err := ctl.openJournal(creds, req.Password)
+	if err != nil {
+		ctl.journalError(c, err)
+		return nil, nil, false
+	}
+	return identity, &unlockedCredentials{creds, keys}, true
+}
+
+// openJournal function will unwrap the user's journal key with the password,
+// which must already be checked.  The first time, the key is created and
+// wrapped with the password instead, along with a new recovery key.  Users
+// without a password give none, and their new key is only wrapped with the
+// recovery key.
+func (ctl *Controller) openJournal(creds *models.Credentials,
+	passwd string) (*journalKeys, error) {
+	if creds.HasJournalKey() {
+		key, err := creds.UnlockJournalKey(passwd)
+		if err != nil {
+			return nil, err
+		}
+		return &journalKeys{key: key}, nil
+	}
+	key, recovery, err := creds.EnrollJournalKey(passwd)
+	if err != nil {
+		return nil, err
+	}
+	// only save the key if no other request has, so the entries are never
+	// sealed with a key that was replaced.
+	result := ctl.DB.Model(creds).
+		Where("journalkey = ? AND journalrecovery = ?", "", "").
+		Select(journalFields()).Updates(creds)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		err = ctl.DB.Select(journalFields()).
+			First(creds, "userid = ?", creds.UserID).Error
+		if err != nil {
+			return nil, err
+		}
+		return ctl.openJournal(creds, passwd)
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Journal Key Created: %s", creds.UserID))
+	return &journalKeys{key: key, recovery: recovery}, nil
+}
+
+// journalStatus function will describe the user's journal, warning them
+// when it has no recovery key.
+func journalStatus(creds *models.Credentials, unlocked bool,
+	recovery string) *journalResponse {
+	status := &journalResponse{
+		Unlocked:    unlocked,
+		Recovery:    creds.HasRecoveryKey(),
+		RecoveryKey: recovery,
+		Warnings:    journalWarnings(creds),
+	}
+	if recovery != "" {
+		status.Warnings = append(status.Warnings, "Print or write down the "+
+			"recovery key; it is needed to read your journal after a "+
+			"forgotten password and won't be shown again")
+	}
+	return status
+}
+
+// journalWarnings function will warn the user when a forgotten password
+// would make their journal unreadable.
+func journalWarnings(creds *models.Credentials) []string {
+	if creds.HasJournalKey() && !creds.HasRecoveryKey() {
+		return []string{"Your journal has no recovery key; create one at " +
+			"/api/v1/user/journal/recovery, or a forgotten password will " +
+			"make your entries unreadable"}
+	}
+	return nil
+}
+
+// journalFields function will provide the credentials' journal key fields
+// along with the other fields given, for saving.
+func journalFields(fields ...string) []string {
+	return append(fields, "privatekey", "journalkey", "journalsalt",
+		"journalkdf", "journalkeyid", "journalrecovery")
+}
+
+func (ctl *Controller) journalError(c *gin.Context, err error) {
+	ctl.Log.WriteToLog(fmt.Sprintf("Journal Key Failure: %s - %s",
+		ctl.userID(c), err.Error()))
+	ctl.sendError(c, &models.ErrorMessage{
+		ErrorType:  "journal",
+		StatusCode: http.StatusInternalServerError,
+		Message:    "journal key failure",
+	})
+}
@@ -0,0 +1,15 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/antonerne/go-soap/models"
+	"github.com/gin-gonic/gin"
+)
+
+// GetJWKS function will provide the public keys for the access tokens, so
+// other services can check the tokens without sharing a secret.
+func (ctl *Controller) GetJWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, models.Keys.JWKS())
+}
@@ -0,0 +1,311 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/antonerne/go-soap/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type oidcStartResponse struct {
+	URL string `json:"url"`
+}
+
+// oidcCookie is the cookie holding the secret of the browser that started a
+// sign in with the identity provider.
+const oidcCookie = "soap_oidc"
+
+// StartOIDCLogin function will start a sign in with the identity provider,
+// providing the address of the provider's sign in page for the web
+// application to send the member to.  The sign in is bound to the browser
+// with a cookie, which the callback requires.
+func (ctl *Controller) StartOIDCLogin(c *gin.Context) {
+	if !ctl.oidcEnabled(c) {
+		return
+	}
+	st, secret, err := models.NewOIDCState()
+	if err == nil {
+		err = ctl.DB.Delete(&models.OIDCState{}, "expires < ?",
+			time.Now()).Error
+		if err == nil {
+			err = ctl.DB.Create(st).Error
+		}
+	}
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	url, err := models.OIDC.AuthURL(st)
+	if err != nil {
+		ctl.Log.WriteToLog(fmt.Sprintf("OIDC Discovery Failure: %s",
+			err.Error()))
+		ctl.sendError(c, &models.ErrorMessage{
+			ErrorType:  "oidc",
+			StatusCode: http.StatusBadGateway,
+			Message:    "Identity provider unavailable",
+		})
+		return
+	}
+	setOIDCCookie(c, secret, int(models.OIDCStateLife.Seconds()))
+	c.JSON(http.StatusOK, oidcStartResponse{URL: url})
+}
+
+type oidcLoginRequest struct {
+	Code  string `json:"code"`
+	State string `json:"state" binding:"required"`
+	OTP   string `json:"otp"`
+}
+
+// OIDCLogin function will complete a sign in with the identity provider,
+// using the code and state the provider sent back to the web application.
+// The provider's account is found by its link, or else linked to the user
+// with the email address the provider verified.  When no user has the
+// address and OIDCProvision is set, an account is created for the member.
+// Users with two-factor authentication send their code with the same state,
+// without the provider's code, when it is asked for.
+func (ctl *Controller) OIDCLogin(c *gin.Context) {
+	var req oidcLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	if !ctl.oidcEnabled(c) {
+		return
+	}
+	remote := c.ClientIP()
+	st, ok := ctl.takeOIDCState(c, req.State)
+	if !ok {
+		return
+	}
+	var user *models.User
+	if st.UserID != "" {
+		// the provider's sign in was checked; only the code is left.
+		var err error
+		if user, err = ctl.loginUser("id = ?", st.UserID); err != nil {
+			ctl.databaseError(c, err)
+			return
+		}
+	} else if user, ok = ctl.checkOIDCLogin(c, st, req.Code); !ok {
+		return
+	}
+	if !ctl.oidcSecondFactor(c, st, user, req.OTP) {
+		return
+	}
+	if device := user.Creds.TouchRemote(remote); device != nil {
+		err := ctl.DB.Model(device).Update("lastseen", device.LastSeen).Error
+		if err != nil {
+			ctl.databaseError(c, err)
+			return
+		}
+	}
+	setOIDCCookie(c, "", -1)
+
+	// users without a password can't unlock the journal with one, so their
+	// journal key is only wrapped with a recovery key, given now.
+	var journal *journalKeys
+	if !user.Creds.HasPassword() && !user.Creds.HasJournalKey() {
+		var err error
+		if journal, err = ctl.openJournal(&user.Creds, ""); err != nil {
+			ctl.Log.WriteToLog(fmt.Sprintf("Journal Key Failure: %s - %s",
+				user.Email, err.Error()))
+		}
+	}
+
+	ctl.startSession(c, user, journal)
+}
+
+// checkOIDCLogin function will trade the provider's code for the member's
+// claims and find their user, checking the user may sign in.
+func (ctl *Controller) checkOIDCLogin(c *gin.Context, st *models.OIDCState,
+	code string) (*models.User, bool) {
+	remote := c.ClientIP()
+	if code == "" {
+		ctl.badRequest(c, errors.New("code is required"))
+		return nil, false
+	}
+	claims, errMsg := models.OIDC.Exchange(st, code)
+	if errMsg != nil {
+		ctl.Log.WriteToLog(fmt.Sprintf("OIDC Login Failure: from %s - %s %v",
+			remote, errMsg.String(), errMsg.Details))
+		ctl.sendError(c, errMsg)
+		return nil, false
+	}
+
+	var link models.OIDCLink
+	var user *models.User
+	ok := true
+	err := ctl.DB.First(&link, "issuer = ? AND subject = ?", claims.Issuer,
+		claims.Subject).Error
+	if err == nil {
+		user, err = ctl.loginUser("id = ?", link.CredentialsUserID)
+	} else if errors.Is(err, gorm.ErrRecordNotFound) {
+		if user, ok = ctl.linkOIDCUser(c, claims); !ok {
+			return nil, false
+		}
+		err = nil
+	}
+	if err != nil {
+		ctl.databaseError(c, err)
+		return nil, false
+	}
+
+	lockCount := user.Creds.LockCount
+	ok, errMsg = user.Creds.LogInOIDC(user.Email, claims)
+	if err = ctl.saveAttempt(user, lockCount, "verified",
+		"verificationtoken"); err != nil {
+		ctl.databaseError(c, err)
+		return nil, false
+	}
+	if !ok {
+		ctl.Log.WriteToLog(fmt.Sprintf("OIDC Login Failure: %s from %s - %s",
+			user.Email, remote, errMsg.String()))
+		ctl.sendError(c, errMsg)
+		return nil, false
+	}
+	err = ctl.DB.Model(&models.OIDCLink{}).
+		Where("issuer = ? AND subject = ?", claims.Issuer, claims.Subject).
+		Update("lastused", time.Now()).Error
+	if err != nil {
+		ctl.databaseError(c, err)
+		return nil, false
+	}
+	return user, true
+}
+
+// oidcSecondFactor function will check the two-factor code of a user who
+// signed in with the provider.  The sign in's state is kept until a good
+// code is given, so the code can be sent without signing in at the provider
+// again.
+func (ctl *Controller) oidcSecondFactor(c *gin.Context, st *models.OIDCState,
+	user *models.User, code string) bool {
+	if !user.Creds.TOTPEnabled {
+		return true
+	}
+	if st.UserID == "" {
+		st.UserID = user.ID
+		st.Expires = time.Now().Add(models.OIDCStateLife)
+	}
+	if err := ctl.DB.Create(st).Error; err != nil {
+		ctl.databaseError(c, err)
+		return false
+	}
+	if !ctl.checkSecondFactor(c, user, code) {
+		return false
+	}
+	if err := ctl.DB.Delete(st).Error; err != nil {
+		ctl.databaseError(c, err)
+		return false
+	}
+	return true
+}
+
+// linkOIDCUser function will link the provider's account to the user with
+// the verified email address, creating the user if OIDCProvision allows it.
+func (ctl *Controller) linkOIDCUser(c *gin.Context,
+	claims *models.OIDCClaims) (*models.User, bool) {
+	noAccount := &models.ErrorMessage{
+		ErrorType:  "oidc",
+		StatusCode: http.StatusForbidden,
+		Message:    "No account for this email address",
+	}
+	if !claims.HasVerifiedEmail() {
+		ctl.sendError(c, &models.ErrorMessage{
+			ErrorType:  "oidc",
+			StatusCode: http.StatusForbidden,
+			Message:    "The identity provider hasn't verified the email address",
+		})
+		return nil, false
+	}
+	link := claims.NewLink("")
+	user, err := ctl.lookupUser(claims.Email)
+	if err == nil {
+		link.CredentialsUserID = user.ID
+		err = ctl.DB.Create(link).Error
+		if err == nil {
+			ctl.Log.WriteToLog(fmt.Sprintf("OIDC Account Linked: %s - %s",
+				user.Email, claims.Issuer))
+		}
+	} else if errors.Is(err, gorm.ErrRecordNotFound) {
+		if !models.OIDCProvision ||
+			models.RegistrationMode == models.RegistrationClosed ||
+			models.RegistrationMode == models.RegistrationInvite {
+			ctl.Log.WriteToLog(fmt.Sprintf("OIDC Unknown Email: %s from %s",
+				claims.Email, c.ClientIP()))
+			ctl.sendError(c, noAccount)
+			return nil, false
+		}
+		user = models.NewOIDCUser(claims)
+		link.CredentialsUserID = user.ID
+		user.Creds.OIDCLinks = []models.OIDCLink{*link}
+		err = ctl.DB.Create(user).Error
+		if err == nil {
+			ctl.Log.WriteToLog(fmt.Sprintf("OIDC Account Created: %s - %s",
+				user.Email, claims.Issuer))
+		}
+	}
+	if err != nil {
+		ctl.databaseError(c, err)
+		return nil, false
+	}
+	return user, true
+}
+
+// takeOIDCState function will load the sign in's state and remove it, so
+// each provider response can only be used once.  The request must come from
+// the browser that started the sign in.
+func (ctl *Controller) takeOIDCState(c *gin.Context,
+	id string) (*models.OIDCState, bool) {
+	var st models.OIDCState
+	err := ctl.DB.First(&st, "id = ?", id).Error
+	var result *gorm.DB
+	if err == nil {
+		result = ctl.DB.Delete(&st)
+		err = result.Error
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) ||
+		(err == nil && (result.RowsAffected == 0 ||
+			st.Expires.Before(time.Now()))) {
+		ctl.sendError(c, &models.ErrorMessage{
+			ErrorType:  "oidc",
+			StatusCode: http.StatusUnauthorized,
+			Message:    "Sign in not found or expired",
+		})
+		return nil, false
+	} else if err != nil {
+		ctl.databaseError(c, err)
+		return nil, false
+	}
+	if secret, _ := c.Cookie(oidcCookie); !st.BoundTo(secret) {
+		ctl.Log.WriteToLog(fmt.Sprintf("OIDC State Not Bound: from %s",
+			c.ClientIP()))
+		ctl.sendError(c, &models.ErrorMessage{
+			ErrorType:  "oidc",
+			StatusCode: http.StatusUnauthorized,
+			Message:    "Sign in wasn't started by this browser",
+		})
+		return nil, false
+	}
+	return &st, true
+}
+
+// setOIDCCookie function will keep the browser's sign in secret in a cookie
+// scripts can't read, only sent to the identity provider routes.
+func setOIDCCookie(c *gin.Context, secret string, maxAge int) {
+	secure := c.Request.TLS != nil ||
+		c.GetHeader("X-Forwarded-Proto") == "https"
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcCookie, secret, maxAge, "/api/v1/auth/oidc", "", secure,
+		true)
+}
+
+func (ctl *Controller) oidcEnabled(c *gin.Context) bool {
+	if models.OIDC == nil {
+		ctl.notFound(c, "identity provider")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,342 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/antonerne/go-soap/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type passkeyOptionsResponse struct {
+	Session   string      `json:"session"`
+	PublicKey interface{} `json:"publicKey"`
+}
+
+// StartPasskeyRegistration function will start the creation of a passkey for
+// the authorized user, providing the options for the browser's
+// navigator.credentials.create call.
+func (ctl *Controller) StartPasskeyRegistration(c *gin.Context) {
+	user, ok := ctl.loadUser(c, ctl.userID(c))
+	if !ok {
+		return
+	}
+	ch, ok := ctl.newChallenge(c, user.ID, models.PasskeyRegistration)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, passkeyOptionsResponse{
+		Session:   ch.ID,
+		PublicKey: user.PasskeyCreationOptions(ch),
+	})
+}
+
+type passkeyRegisterRequest struct {
+	Session    string `json:"session" binding:"required"`
+	Label      string `json:"label"`
+	Password   string `json:"password"`
+	OTP        string `json:"otp"`
+	Credential struct {
+		Response models.AttestationResponse `json:"response" binding:"required"`
+	} `json:"credential" binding:"required"`
+}
+
+// FinishPasskeyRegistration function will save the passkey the authorized
+// user's browser created, after checking it against the challenge.  A
+// passkey signs the user in without their password or TOTP code, so the user
+// must give one of them, and an access token alone can't add a passkey.
+func (ctl *Controller) FinishPasskeyRegistration(c *gin.Context) {
+	var req passkeyRegisterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	ch, ok := ctl.takeChallenge(c, req.Session, models.PasskeyRegistration)
+	if !ok {
+		return
+	}
+	user, ok := ctl.loadUser(c, ctl.userID(c))
+	if !ok {
+		return
+	}
+	if ch.UserID != user.ID {
+		ctl.sendError(c, &models.ErrorMessage{
+			ErrorType:  "passkey",
+			StatusCode: http.StatusUnauthorized,
+			Message:    "Passkey verification failed",
+		})
+		return
+	}
+	lockCount := user.Creds.LockCount
+	ok, errMsg := user.Creds.Reauthenticate(req.Password, req.OTP)
+	if err := ctl.saveAttempt(user, lockCount, "totplaststep"); err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	if !ok {
+		ctl.Log.WriteToLog(fmt.Sprintf("Passkey Registration Failure: %s from %s - %s",
+			user.Email, c.ClientIP(), errMsg.String()))
+		ctl.sendError(c, errMsg)
+		return
+	}
+	label := req.Label
+	if label == "" {
+		label = models.DeviceLabel(c.Request.UserAgent())
+	}
+	passkey, errMsg := user.Creds.AddPasskey(ch, &req.Credential.Response,
+		label)
+	if errMsg != nil {
+		ctl.Log.WriteToLog(fmt.Sprintf("Passkey Registration Failure: %s - %v",
+			user.Email, errMsg.Details))
+		ctl.sendError(c, errMsg)
+		return
+	}
+	if err := ctl.DB.Create(passkey).Error; err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Passkey Added: %s (%s)", user.Email,
+		passkey.Label))
+	c.JSON(http.StatusCreated, passkey)
+}
+
+// GetPasskeys function will provide the authorized user's passkeys.
+func (ctl *Controller) GetPasskeys(c *gin.Context) {
+	var passkeys []models.WebAuthnCredential
+	err := ctl.DB.Order("created").
+		Find(&passkeys, "userid = ?", ctl.userID(c)).Error
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, passkeys)
+}
+
+// UpdatePasskey function will change the label of one of the authorized
+// user's passkeys.
+func (ctl *Controller) UpdatePasskey(c *gin.Context) {
+	var req deviceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	passkey, ok := ctl.paramPasskey(c)
+	if !ok {
+		return
+	}
+	passkey.Label = req.Label
+	if err := ctl.DB.Model(passkey).Update("label", passkey.Label).Error; err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, passkey)
+}
+
+// DeletePasskey function will remove one of the authorized user's passkeys,
+// so it can't be used to sign in again.
+func (ctl *Controller) DeletePasskey(c *gin.Context) {
+	passkey, ok := ctl.paramPasskey(c)
+	if !ok {
+		return
+	}
+	if err := ctl.DB.Delete(passkey).Error; err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Passkey Removed: %s - %s", ctl.userID(c),
+		passkey.Label))
+	c.Status(http.StatusNoContent)
+}
+
+type passkeyLoginOptionsRequest struct {
+	Email string `json:"email"`
+}
+
+// StartPasskeyLogin function will start a sign in with a passkey, providing
+// the options for the browser's navigator.credentials.get call.  When an
+// email address is given, the user's passkeys are listed for the browser;
+// otherwise the browser offers the passkeys it holds for the site.  An
+// unknown address is treated as no address, so the response won't show which
+// addresses have accounts.
+func (ctl *Controller) StartPasskeyLogin(c *gin.Context) {
+	var req passkeyLoginOptionsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	userID := ""
+	passkeys := make([]models.WebAuthnCredential, 0)
+	if req.Email != "" {
+		user, err := ctl.lookupUser(req.Email)
+		if err == nil {
+			userID = user.ID
+			passkeys = user.Creds.Passkeys
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			ctl.databaseError(c, err)
+			return
+		}
+	}
+	ch, ok := ctl.newChallenge(c, userID, models.PasskeyLogin)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, passkeyOptionsResponse{
+		Session:   ch.ID,
+		PublicKey: models.PasskeyRequestOptions(ch, passkeys),
+	})
+}
+
+type passkeyLoginRequest struct {
+	Session    string `json:"session" binding:"required"`
+	Credential struct {
+		ID       string                   `json:"id" binding:"required"`
+		Response models.AssertionResponse `json:"response" binding:"required"`
+	} `json:"credential" binding:"required"`
+}
+
+// PasskeyLogin function will complete a sign in with a passkey, checking the
+// browser's response against the challenge and the passkey's public key, and
+// saving the result of the attempt to the user's credentials like Login.
+func (ctl *Controller) PasskeyLogin(c *gin.Context) {
+	var req passkeyLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	passkeyFailure := &models.ErrorMessage{
+		ErrorType:  "passkey",
+		StatusCode: http.StatusUnauthorized,
+		Message:    "Passkey verification failed",
+	}
+	remote := c.ClientIP()
+
+	ch, ok := ctl.takeChallenge(c, req.Session, models.PasskeyLogin)
+	if !ok {
+		return
+	}
+	var stored models.WebAuthnCredential
+	err := ctl.DB.First(&stored, "credentialid = ?", req.Credential.ID).Error
+	if err == nil && ch.UserID != "" && ch.UserID != stored.CredentialsUserID {
+		err = gorm.ErrRecordNotFound
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		ctl.Log.WriteToLog(fmt.Sprintf("Unknown Passkey: from %s", remote))
+		ctl.sendError(c, passkeyFailure)
+		return
+	} else if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	user, err := ctl.loginUser("id = ?", stored.CredentialsUserID)
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	passkey := user.Creds.FindPasskey(stored.CredentialID)
+	if passkey == nil {
+		ctl.sendError(c, passkeyFailure)
+		return
+	}
+
+	lockCount := user.Creds.LockCount
+	ok, errMsg := user.Creds.LogInPasskey(ch, passkey, &req.Credential.Response)
+	if err = ctl.saveAttempt(user, lockCount); err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	if !ok {
+		ctl.Log.WriteToLog(fmt.Sprintf("Passkey Login Failure: %s from %s - %s %v",
+			user.Email, remote, errMsg.String(), errMsg.Details))
+		ctl.sendError(c, errMsg)
+		return
+	}
+	err = ctl.DB.Model(passkey).Select("signcount", "lastused").
+		Updates(passkey).Error
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	if device := user.Creds.TouchRemote(remote); device != nil {
+		err = ctl.DB.Model(device).Update("lastseen", device.LastSeen).Error
+		if err != nil {
+			ctl.databaseError(c, err)
+			return
+		}
+	}
+
+	ctl.startSession(c, user, nil)
+}
+
+// newChallenge function will create and store the challenge for a passkey
+// ceremony, removing the challenges that expired without being used.
+func (ctl *Controller) newChallenge(c *gin.Context, userID string,
+	ceremony string) (*models.WebAuthnChallenge, bool) {
+	ch, err := models.NewWebAuthnChallenge(userID, ceremony)
+	if err != nil {
+		ctl.Log.WriteToLog(err.Error())
+		ctl.sendError(c, &models.ErrorMessage{
+			ErrorType:  "passkey",
+			StatusCode: http.StatusInternalServerError,
+			Message:    "challenge creation failure",
+		})
+		return nil, false
+	}
+	err = ctl.DB.Delete(&models.WebAuthnChallenge{}, "expires < ?",
+		time.Now()).Error
+	if err == nil {
+		err = ctl.DB.Create(ch).Error
+	}
+	if err != nil {
+		ctl.databaseError(c, err)
+		return nil, false
+	}
+	return ch, true
+}
+
+// takeChallenge function will load the challenge for the ceremony and remove
+// it, so each challenge can only be answered once.
+func (ctl *Controller) takeChallenge(c *gin.Context, id string,
+	ceremony string) (*models.WebAuthnChallenge, bool) {
+	var ch models.WebAuthnChallenge
+	err := ctl.DB.First(&ch, "id = ? AND ceremony = ?", id, ceremony).Error
+	var result *gorm.DB
+	if err == nil {
+		result = ctl.DB.Delete(&ch)
+		err = result.Error
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) ||
+		(err == nil && result.RowsAffected == 0) {
+		ctl.sendError(c, &models.ErrorMessage{
+			ErrorType:  "passkey",
+			StatusCode: http.StatusUnauthorized,
+			Message:    "Passkey challenge not found or already used",
+		})
+		return nil, false
+	} else if err != nil {
+		ctl.databaseError(c, err)
+		return nil, false
+	}
+	return &ch, true
+}
+
+func (ctl *Controller) paramPasskey(
+	c *gin.Context) (*models.WebAuthnCredential, bool) {
+	id, ok := ctl.paramID(c, "id")
+	if !ok {
+		return nil, false
+	}
+	var passkey models.WebAuthnCredential
+	err := ctl.DB.First(&passkey, "id = ? AND userid = ?", id,
+		ctl.userID(c)).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		ctl.notFound(c, "passkey")
+		return nil, false
+	} else if err != nil {
+		ctl.databaseError(c, err)
+		return nil, false
+	}
+	return &passkey, true
+}
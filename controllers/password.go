@@ -0,0 +1,219 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/antonerne/go-soap/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type forgotRequest struct {
+	Email string `json:"email" binding:"required"`
+}
+
+// ForgotPassword function will start the reset password process, sending a
+// reset token to the user no more often than models.ResetResendWait.  The
+// response is the same whether or not the email address has an account.
+func (ctl *Controller) ForgotPassword(c *gin.Context) {
+	var req forgotRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	user, err := ctl.lookupUser(req.Email)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		ctl.Log.WriteToLog(fmt.Sprintf("Forgot Password Unknown Email: %s from %s",
+			req.Email, c.ClientIP()))
+		c.Status(http.StatusAccepted)
+		return
+	} else if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+
+	// the response is the same when a token was just sent, so it doesn't
+	// tell if the address has an account.
+	if !user.Creds.CanResendReset() {
+		ctl.Log.WriteToLog(fmt.Sprintf("Forgot Password Too Soon: %s from %s",
+			user.Email, c.ClientIP()))
+		c.Status(http.StatusAccepted)
+		return
+	}
+	code := user.Creds.StartForgot()
+	err = ctl.saveCreds(&user.Creds, "resettoken", "resetexpires",
+		"resetattempts")
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	err = ctl.Notifier.SendReset(user, code, user.Creds.ResetExpires)
+	if err != nil {
+		ctl.Log.WriteToLog(fmt.Sprintf("Reset Token Not Sent: %s - %s",
+			user.Email, err.Error()))
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Forgot Password: %s from %s", user.Email,
+		c.ClientIP()))
+	c.Status(http.StatusAccepted)
+}
+
+type resetRequest struct {
+	Email          string `json:"email" binding:"required"`
+	Token          string `json:"token" binding:"required"`
+	Password       string `json:"password" binding:"required"`
+	RecoveryKey    string `json:"recovery_key"`
+	DiscardJournal bool   `json:"discard_journal"`
+}
+
+// ResetPassword function will complete the reset password process with the
+// token sent to the user, then revoke all the user's sessions.  The journal
+// key can't be unwrapped without the old password, so the user's recovery
+// key is needed to keep their entries readable.  Without it the reset stops
+// with a warning, unless the user chose to discard the journal and start a
+// new one, when the new recovery key is given in the response.
+func (ctl *Controller) ResetPassword(c *gin.Context) {
+	var req resetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	user, ok := ctl.findUserByEmail(c, req.Email)
+	if !ok {
+		return
+	}
+
+	ok, errMsg := user.Creds.CheckResetToken(req.Token)
+	var master []byte
+	if ok {
+		master, errMsg = user.Creds.ResetJournal(req.RecoveryKey,
+			req.DiscardJournal)
+		ok = errMsg == nil
+	}
+	if ok {
+		ok, errMsg = user.Creds.ResetPassword(req.Token, req.Password)
+	}
+	var recovery, note string
+	var err error
+	if ok && user.Creds.HasJournalKey() {
+		if master != nil {
+			err = user.Creds.RewrapJournalKey(master, req.Password)
+			note = " - journal key recovered"
+		} else {
+			_, recovery, err = user.Creds.ResetJournalKey(req.Password)
+			note = " - journal key replaced"
+		}
+		if err != nil {
+			ctl.journalError(c, err)
+			return
+		}
+	}
+	if ok {
+		err = ctl.savePassword(&user.Creds, journalFields("resettoken",
+			"resetexpires", "resetattempts")...)
+	} else {
+		err = ctl.saveCreds(&user.Creds, "resettoken", "resetexpires",
+			"resetattempts")
+	}
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	if !ok {
+		ctl.Log.WriteToLog(fmt.Sprintf("Reset Password Failure: %s from %s - %s",
+			user.Email, c.ClientIP(), errMsg.String()))
+		ctl.sendError(c, errMsg)
+		return
+	}
+	if err = ctl.revokeSessions(user.ID); err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Reset Password: %s from %s%s", user.Email,
+		c.ClientIP(), note))
+	if recovery == "" {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	status := journalStatus(&user.Creds, false, recovery)
+	status.Warnings = append(status.Warnings, "Your journal was started "+
+		"again; entries sealed with the previous journal key can't be read "+
+		"and are listed as unreadable")
+	c.JSON(http.StatusOK, status)
+}
+
+type changePasswordRequest struct {
+	Current  string `json:"current" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// ChangePassword function will change the authorized user's password after
+// checking their current password, wrapping the user's journal key with the
+// new password.  The recovery key is only given when the journal key was
+// created for the change.
+func (ctl *Controller) ChangePassword(c *gin.Context) {
+	var req changePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	user, err := ctl.loginUser("id = ?", ctl.userID(c))
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	if !ctl.checkCurrentPassword(c, user, req.Current, "Change Password") {
+		return
+	}
+	creds := &user.Creds
+	// the new password is checked before the journal key can be created, so
+	// a refused password never leaves a recovery key that isn't shown.
+	if ok, errMsg := creds.SetPassword(req.Password); !ok {
+		ctl.sendError(c, errMsg)
+		return
+	}
+	journal, err := ctl.openJournal(creds, req.Current)
+	if err != nil {
+		ctl.journalError(c, err)
+		return
+	}
+	if err = creds.RewrapJournalKey(journal.key, req.Password); err != nil {
+		ctl.journalError(c, err)
+		return
+	}
+	if err = ctl.savePassword(creds, journalFields()...); err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Change Password: %s", ctl.userID(c)))
+	if journal.recovery == "" {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	// the journal key was just created with the current password, so the
+	// user must be shown its recovery key.
+	identity, _ := models.GetIdentity(c)
+	models.SessionKeys.Put(identity.SessionID, identity.UserID, journal.key)
+	c.JSON(http.StatusOK, journalStatus(creds, true, journal.recovery))
+}
+
+// checkCurrentPassword function will check the password the authorized user
+// gave before a change to their account, saving the attempt so wrong
+// passwords lock the account as they do at log in.
+func (ctl *Controller) checkCurrentPassword(c *gin.Context, user *models.User,
+	passwd string, action string) bool {
+	lockCount := user.Creds.LockCount
+	ok, errMsg := user.Creds.CheckPasswordAttempt(passwd)
+	if err := ctl.saveAttempt(user, lockCount); err != nil {
+		ctl.databaseError(c, err)
+		return false
+	}
+	if !ok {
+		ctl.Log.WriteToLog(fmt.Sprintf("%s Failure: %s from %s - %s", action,
+			user.Email, c.ClientIP(), errMsg.String()))
+		ctl.sendError(c, errMsg)
+		return false
+	}
+	return true
+}
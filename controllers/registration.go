@@ -0,0 +1,216 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/antonerne/go-soap/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Register function will create a new account from the registration, then
+// start the email verification.  The server's registration mode decides if
+// an invite code is required or if an editor must approve the account.  The
+// journal key is created at the user's first sign in, which gives them its
+// recovery key.
+func (ctl *Controller) Register(c *gin.Context) {
+	var reg models.Registration
+	if err := c.ShouldBindJSON(&reg); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	if models.RegistrationMode == models.RegistrationClosed {
+		ctl.sendError(c, &models.ErrorMessage{
+			ErrorType:  "registration",
+			StatusCode: http.StatusForbidden,
+			Message:    "Registration is closed",
+		})
+		return
+	}
+	if errMsg := reg.Validate(); errMsg != nil {
+		ctl.sendError(c, errMsg)
+		return
+	}
+
+	var invite models.Invite
+	if models.RegistrationMode == models.RegistrationInvite {
+		err := ctl.DB.First(&invite, "code = ?",
+			strings.ToUpper(reg.Invite)).Error
+		if err == nil && !invite.IsValidFor(reg.Email) {
+			err = gorm.ErrRecordNotFound
+		}
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctl.sendError(c, &models.ErrorMessage{
+				ErrorType:  "registration",
+				StatusCode: http.StatusForbidden,
+				Message:    "Invalid invite code",
+			})
+			return
+		} else if err != nil {
+			ctl.databaseError(c, err)
+			return
+		}
+	}
+
+	user, errMsg := reg.NewUser()
+	if errMsg != nil {
+		ctl.sendError(c, errMsg)
+		return
+	}
+	// the response is the same for an address that already has an account,
+	// so registering doesn't tell who has one; the account's owner is told
+	// by email instead.
+	existing, err := ctl.lookupUser(reg.Email)
+	if err == nil {
+		err = ctl.Notifier.SendRegistered(existing)
+		if err != nil {
+			ctl.Log.WriteToLog(fmt.Sprintf("Registered Notice Not Sent: %s - %s",
+				existing.Email, err.Error()))
+		}
+		ctl.Log.WriteToLog(fmt.Sprintf("Register Existing Email: %s from %s",
+			existing.Email, c.ClientIP()))
+		c.Status(http.StatusAccepted)
+		return
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		ctl.databaseError(c, err)
+		return
+	}
+
+	err = ctl.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		if invite.Code == "" {
+			return nil
+		}
+		// claim the invite only if no other registration has.
+		result := tx.Model(&invite).Where("usedby = ?", "").
+			Updates(map[string]interface{}{
+				"usedby": user.ID,
+				"used":   time.Now(),
+			})
+		if result.Error == nil && result.RowsAffected == 0 {
+			return errors.New("invite already used")
+		}
+		return result.Error
+	})
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+
+	ctl.sendVerification(user)
+	ctl.Log.WriteToLog(fmt.Sprintf("Registered: %s from %s", user.Email,
+		c.ClientIP()))
+	c.Status(http.StatusAccepted)
+}
+
+type inviteRequest struct {
+	Email string `json:"email"`
+}
+
+// CreateInvite function will create an invite code for an editor to give to
+// a new member, optionally limited to the member's email address.
+func (ctl *Controller) CreateInvite(c *gin.Context) {
+	var req inviteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	invite := models.NewInvite(ctl.userID(c), req.Email)
+	if err := ctl.DB.Create(invite).Error; err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Invite Created: %s by %s", invite.Code,
+		ctl.userID(c)))
+	c.JSON(http.StatusCreated, invite)
+}
+
+// GetInvites function will provide the invites that haven't been used or
+// expired.
+func (ctl *Controller) GetInvites(c *gin.Context) {
+	var invites []models.Invite
+	err := ctl.DB.Order("created desc").
+		Find(&invites, "usedby = ? AND expires > ?", "", time.Now()).Error
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, invites)
+}
+
+func (ctl *Controller) DeleteInvite(c *gin.Context) {
+	result := ctl.DB.Delete(&models.Invite{}, "code = ?", c.Param("code"))
+	if result.Error != nil {
+		ctl.databaseError(c, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		ctl.notFound(c, "invite")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GetRegistrations function will provide the accounts waiting for an
+// editor's approval.
+func (ctl *Controller) GetRegistrations(c *gin.Context) {
+	var users []models.User
+	err := ctl.DB.Preload("Name").Preload("Creds").
+		Joins("JOIN user_credentials ON user_credentials.userid = users.id").
+		Where("user_credentials.pending = ?", true).
+		Find(&users).Error
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, users)
+}
+
+// ApproveRegistration function will allow a pending account to log in.
+func (ctl *Controller) ApproveRegistration(c *gin.Context) {
+	user, ok := ctl.paramRegistration(c)
+	if !ok {
+		return
+	}
+	user.Creds.PendingApproval = false
+	if err := ctl.saveCreds(&user.Creds, "pending"); err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Registration Approved: %s by %s",
+		user.Email, ctl.userID(c)))
+	c.JSON(http.StatusOK, user)
+}
+
+// RejectRegistration function will remove a pending account.
+func (ctl *Controller) RejectRegistration(c *gin.Context) {
+	user, ok := ctl.paramRegistration(c)
+	if !ok {
+		return
+	}
+	if err := ctl.DB.Delete(user).Error; err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Registration Rejected: %s by %s",
+		user.Email, ctl.userID(c)))
+	c.Status(http.StatusNoContent)
+}
+
+func (ctl *Controller) paramRegistration(c *gin.Context) (*models.User, bool) {
+	user, ok := ctl.loadUser(c, c.Param("id"))
+	if !ok {
+		return nil, false
+	}
+	if !user.Creds.PendingApproval {
+		ctl.notFound(c, "registration")
+		return nil, false
+	}
+	return user, true
+}
@@ -0,0 +1,267 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/antonerne/go-soap/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type permissionResponse struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// GetPermissions function will provide the permissions roles can grant.
+func (ctl *Controller) GetPermissions(c *gin.Context) {
+	perms := make([]permissionResponse, 0)
+	for name, description := range models.Permissions {
+		perms = append(perms, permissionResponse{
+			Name:        name,
+			Description: description,
+		})
+	}
+	sort.Slice(perms, func(i, j int) bool {
+		return perms[i].Name < perms[j].Name
+	})
+	c.JSON(http.StatusOK, perms)
+}
+
+// GetRoles function will provide the roles with their permissions.
+func (ctl *Controller) GetRoles(c *gin.Context) {
+	var roles []models.Role
+	err := ctl.DB.Preload("Permissions").Order("name").Find(&roles).Error
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, roles)
+}
+
+type roleRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// CreateRole function will create a new role with the permissions given.
+func (ctl *Controller) CreateRole(c *gin.Context) {
+	var req roleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	role := models.NewRole(req.Name, req.Description, req.Permissions...)
+	if errMsg := role.Validate(); errMsg != nil {
+		ctl.sendError(c, errMsg)
+		return
+	}
+	var count int64
+	err := ctl.DB.Model(&models.Role{}).Where("name = ?", role.Name).
+		Count(&count).Error
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	if count > 0 {
+		ctl.sendError(c, &models.ErrorMessage{
+			ErrorType:  "role",
+			StatusCode: http.StatusConflict,
+			Message:    "Role already exists",
+		})
+		return
+	}
+	if err = ctl.DB.Create(&role).Error; err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Role Created: %s by %s", role.Name,
+		ctl.userID(c)))
+	c.JSON(http.StatusCreated, role)
+}
+
+// UpdateRole function will change a role's description and replace its
+// permissions.
+func (ctl *Controller) UpdateRole(c *gin.Context) {
+	var req roleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	role, ok := ctl.paramRole(c)
+	if !ok {
+		return
+	}
+	role.Description = req.Description
+	role.SetPermissions(req.Permissions)
+	if errMsg := role.Validate(); errMsg != nil {
+		ctl.sendError(c, errMsg)
+		return
+	}
+	err := ctl.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(role).Update("description", role.Description).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Delete(&models.RolePermission{}, "role = ?", role.Name).Error
+		if err != nil || len(role.Permissions) == 0 {
+			return err
+		}
+		return tx.Create(&role.Permissions).Error
+	})
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Role Updated: %s by %s", role.Name,
+		ctl.userID(c)))
+	c.JSON(http.StatusOK, role)
+}
+
+// DeleteRole function will remove a role from the users who have it and
+// then remove the role.  The editor role can't be removed.
+func (ctl *Controller) DeleteRole(c *gin.Context) {
+	role, ok := ctl.paramRole(c)
+	if !ok {
+		return
+	}
+	if role.Name == models.RoleEditor {
+		ctl.sendError(c, &models.ErrorMessage{
+			ErrorType:  "role",
+			StatusCode: http.StatusConflict,
+			Message:    "The editor role can't be removed",
+		})
+		return
+	}
+	err := ctl.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Delete(&models.UserRole{}, "role = ?", role.Name).Error
+		if err == nil {
+			err = tx.Delete(&models.RolePermission{}, "role = ?",
+				role.Name).Error
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Delete(role).Error
+	})
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Role Removed: %s by %s", role.Name,
+		ctl.userID(c)))
+	c.Status(http.StatusNoContent)
+}
+
+type userRoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// AddUserRole function will give a role to a user.  The role takes effect
+// at once, though the user's token only shows it after it is refreshed.
+func (ctl *Controller) AddUserRole(c *gin.Context) {
+	var req userRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	user, ok := ctl.loadUser(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	var role models.Role
+	err := ctl.DB.First(&role, "name = ?", req.Role).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		ctl.notFound(c, "role")
+		return
+	} else if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	if !user.HasRole(role.Name) {
+		userRole := models.UserRole{UserID: user.ID, RoleName: role.Name}
+		err = ctl.audited(c, user, models.AuditRoleAdded, role.Name,
+			func(tx *gorm.DB) error {
+				return tx.Clauses(clause.OnConflict{DoNothing: true}).
+					Create(&userRole).Error
+			})
+		if err != nil {
+			ctl.databaseError(c, err)
+			return
+		}
+		user.Roles = append(user.Roles, userRole)
+		ctl.Log.WriteToLog(fmt.Sprintf("Role Given: %s to %s by %s",
+			role.Name, user.Email, ctl.userID(c)))
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// RemoveUserRole function will take a role away from a user.  The last
+// editor can't lose the editor role, so someone can always manage the
+// roles.
+func (ctl *Controller) RemoveUserRole(c *gin.Context) {
+	user, ok := ctl.loadUser(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	name := c.Param("role")
+	if !user.HasRole(name) {
+		ctl.notFound(c, "user role")
+		return
+	}
+	if name == models.RoleEditor {
+		var count int64
+		err := ctl.DB.Model(&models.UserRole{}).Where("role = ?", name).
+			Count(&count).Error
+		if err != nil {
+			ctl.databaseError(c, err)
+			return
+		}
+		if count < 2 {
+			ctl.sendError(c, &models.ErrorMessage{
+				ErrorType:  "role",
+				StatusCode: http.StatusConflict,
+				Message:    "The last editor can't be removed",
+			})
+			return
+		}
+	}
+	err := ctl.audited(c, user, models.AuditRoleRemoved, name,
+		func(tx *gorm.DB) error {
+			return tx.Delete(&models.UserRole{}, "userid = ? AND role = ?",
+				user.ID, name).Error
+		})
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	roles := make([]models.UserRole, 0)
+	for _, role := range user.Roles {
+		if role.RoleName != name {
+			roles = append(roles, role)
+		}
+	}
+	user.Roles = roles
+	ctl.Log.WriteToLog(fmt.Sprintf("Role Removed: %s from %s by %s", name,
+		user.Email, ctl.userID(c)))
+	c.JSON(http.StatusOK, user)
+}
+
+func (ctl *Controller) paramRole(c *gin.Context) (*models.Role, bool) {
+	var role models.Role
+	err := ctl.DB.Preload("Permissions").
+		First(&role, "name = ?", c.Param("name")).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		ctl.notFound(c, "role")
+		return nil, false
+	} else if err != nil {
+		ctl.databaseError(c, err)
+		return nil, false
+	}
+	return &role, true
+}
@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"github.com/antonerne/go-soap/models"
+	"github.com/gin-gonic/gin"
+)
+
+// Routes function will register the version 1 API with the router.
+func (ctl *Controller) Routes(router *gin.Engine) {
+	router.GET("/.well-known/jwks.json", ctl.GetJWKS)
+
+	api := router.Group("/api/v1")
+	authorized := models.AuthorizeJWT(ctl.DB, ctl.Log)
+	session := models.RequireSession()
+	mustChange := models.AllowMustChange()
+	require := func(perm string) gin.HandlerFunc {
+		return models.RequirePermission(ctl.DB, ctl.Log, perm)
+	}
+
+	auth := api.Group("/auth")
+	{
+		auth.POST("/register", ctl.Register)
+		auth.POST("/login", ctl.Login)
+		auth.POST("/refresh", ctl.Refresh)
+		auth.POST("/remote", ctl.VerifyRemote)
+		auth.POST("/forgot", ctl.ForgotPassword)
+		auth.POST("/reset", ctl.ResetPassword)
+		auth.POST("/verify", ctl.VerifyEmail)
+		auth.POST("/verify/resend", ctl.ResendVerification)
+		auth.POST("/passkey/options", ctl.StartPasskeyLogin)
+		auth.POST("/passkey", ctl.PasskeyLogin)
+		auth.POST("/oidc/start", ctl.StartOIDCLogin)
+		auth.POST("/oidc/callback", ctl.OIDCLogin)
+		auth.POST("/logout", mustChange, authorized, session, ctl.Logout)
+	}
+
+	books := api.Group("/books")
+	{
+		books.GET("", ctl.GetBibleBooks)
+		books.GET("/:id", ctl.GetBibleBook)
+	}
+
+	studies := api.Group("/studies", authorized)
+	{
+		studies.GET("", ctl.GetBibleStudies)
+		studies.GET("/:id", ctl.GetBibleStudy)
+	}
+
+	studyEdit := api.Group("/studies", authorized,
+		require(models.PermStudiesEdit))
+	{
+		studyEdit.POST("", ctl.CreateBibleStudy)
+		studyEdit.PUT("/:id", ctl.UpdateBibleStudy)
+		studyEdit.DELETE("/:id", ctl.DeleteBibleStudy)
+	}
+
+	// users who must change their password can only see their account,
+	// change the password and sign out.
+	api.GET("/user", mustChange, authorized, ctl.GetCurrentUser)
+	api.PUT("/user/password", mustChange, authorized, session,
+		ctl.ChangePassword)
+
+	user := api.Group("/user", authorized)
+	{
+		user.POST("/totp", session, ctl.StartTOTP)
+		user.POST("/totp/confirm", session, ctl.ConfirmTOTP)
+		user.POST("/totp/recovery", session, ctl.RegenerateRecoveryCodes)
+		user.DELETE("/totp", session, ctl.DisableTOTP)
+		user.POST("/passkeys/options", session, ctl.StartPasskeyRegistration)
+		user.POST("/passkeys", session, ctl.FinishPasskeyRegistration)
+		user.GET("/passkeys", session, ctl.GetPasskeys)
+		user.PUT("/passkeys/:id", session, ctl.UpdatePasskey)
+		user.DELETE("/passkeys/:id", session, ctl.DeletePasskey)
+		user.GET("/apikeys", session, ctl.GetAPIKeys)
+		user.POST("/apikeys", session, ctl.CreateAPIKey)
+		user.DELETE("/apikeys/:id", session, ctl.DeleteAPIKey)
+		user.GET("/journal", ctl.GetJournal)
+		user.POST("/journal/recovery", session, ctl.CreateRecoveryKey)
+		user.GET("/studies", ctl.GetUserStudies)
+		user.POST("/studies", ctl.StartUserStudy)
+		user.DELETE("/studies/:id", ctl.DeleteUserStudy)
+	}
+
+	// unlocking the journal only changes the session, so read keys may
+	// unlock it to read the entries.  Wrong passwords and recovery keys
+	// count toward the account's lockout, so a read key can't be used to
+	// guess them.
+	readScope := models.AllowReadScope()
+	api.POST("/user/journal/unlock", readScope, authorized, ctl.UnlockJournal)
+	api.POST("/user/journal/lock", readScope, authorized, ctl.LockJournal)
+
+	entries := api.Group("/entries", authorized)
+	{
+		entries.GET("", ctl.GetEntries)
+		entries.GET("/:id", ctl.GetEntry)
+		entries.GET("/:id/document", ctl.GetEntryDocument)
+		entries.POST("", ctl.CreateEntry)
+		entries.PUT("/:id", ctl.UpdateEntry)
+		entries.DELETE("/:id", ctl.DeleteEntry)
+	}
+
+	devices := api.Group("/devices", authorized, session)
+	{
+		devices.GET("", ctl.GetDevices)
+		devices.PUT("/:id", ctl.UpdateDevice)
+		devices.DELETE("/:id", ctl.DeleteDevice)
+	}
+
+	sessions := api.Group("/sessions", authorized, session)
+	{
+		sessions.GET("", ctl.GetSessions)
+		sessions.DELETE("", ctl.DeleteSessions)
+		sessions.DELETE("/:id", ctl.DeleteSession)
+	}
+
+	invites := api.Group("/invites", authorized,
+		require(models.PermUsersManage))
+	{
+		invites.GET("", ctl.GetInvites)
+		invites.POST("", ctl.CreateInvite)
+		invites.DELETE("/:code", ctl.DeleteInvite)
+	}
+
+	registrations := api.Group("/registrations", authorized,
+		require(models.PermUsersManage))
+	{
+		registrations.GET("", ctl.GetRegistrations)
+		registrations.POST("/:id/approve", ctl.ApproveRegistration)
+		registrations.DELETE("/:id", ctl.RejectRegistration)
+	}
+
+	users := api.Group("/users", authorized)
+	{
+		view := require(models.PermUsersView)
+		manage := require(models.PermUsersManage)
+		roles := require(models.PermRolesManage)
+		users.GET("", view, ctl.GetUsers)
+		users.GET("/:id", view, ctl.GetUser)
+		users.PUT("/:id", manage, ctl.UpdateUser)
+		users.DELETE("/:id", manage, ctl.DeleteUser)
+		users.GET("/:id/audit", manage, ctl.GetUserAuditLog)
+		users.POST("/:id/mustchange", manage, ctl.ForcePasswordChange)
+		users.POST("/:id/lock", manage, ctl.LockUser)
+		users.GET("/:id/studies", require(models.PermProgressView),
+			ctl.GetMemberStudies)
+		users.POST("/:id/unlock", manage, ctl.UnlockUser)
+		users.DELETE("/:id/totp", manage, ctl.ResetUserTOTP)
+		users.GET("/:id/sessions", manage, ctl.GetUserSessions)
+		users.DELETE("/:id/sessions", manage, ctl.DeleteUserSessions)
+		users.DELETE("/:id/sessions/:session", manage, ctl.DeleteUserSession)
+		users.GET("/:id/apikeys", manage, ctl.GetUserAPIKeys)
+		users.DELETE("/:id/apikeys/:key", manage, ctl.DeleteUserAPIKey)
+		users.POST("/:id/roles", roles, ctl.AddUserRole)
+		users.DELETE("/:id/roles/:role", roles, ctl.RemoveUserRole)
+	}
+
+	api.GET("/audit", authorized, require(models.PermUsersManage),
+		ctl.GetAuditLog)
+
+	roles := api.Group("/roles", authorized, require(models.PermRolesManage))
+	{
+		roles.GET("", ctl.GetRoles)
+		roles.POST("", ctl.CreateRole)
+		roles.PUT("/:name", ctl.UpdateRole)
+		roles.DELETE("/:name", ctl.DeleteRole)
+		roles.GET("/permissions", ctl.GetPermissions)
+	}
+}
@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/antonerne/go-soap/models"
+	"github.com/gin-gonic/gin"
+)
+
+// GetSessions function will provide the authorized user's active sessions.
+func (ctl *Controller) GetSessions(c *gin.Context) {
+	ctl.sendSessions(c, ctl.userID(c))
+}
+
+// DeleteSession function will revoke one of the authorized user's sessions.
+func (ctl *Controller) DeleteSession(c *gin.Context) {
+	ctl.deleteSession(c, ctl.userID(c), c.Param("id"))
+}
+
+// DeleteSessions function will revoke all the authorized user's sessions,
+// including the one used for this request, and remove their API keys.
+func (ctl *Controller) DeleteSessions(c *gin.Context) {
+	if err := ctl.revokeSessions(ctl.userID(c)); err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Sessions Revoked: %s", ctl.userID(c)))
+	c.Status(http.StatusNoContent)
+}
+
+// GetUserSessions function will provide an editor with the active sessions
+// of any account.
+func (ctl *Controller) GetUserSessions(c *gin.Context) {
+	user, ok := ctl.loadUser(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	ctl.sendSessions(c, user.ID)
+}
+
+func (ctl *Controller) DeleteUserSession(c *gin.Context) {
+	user, ok := ctl.loadUser(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	ctl.deleteSession(c, user.ID, c.Param("session"))
+}
+
+func (ctl *Controller) DeleteUserSessions(c *gin.Context) {
+	user, ok := ctl.loadUser(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if err := ctl.revokeSessions(user.ID); err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Sessions Revoked: %s by %s", user.ID,
+		ctl.userID(c)))
+	c.Status(http.StatusNoContent)
+}
+
+func (ctl *Controller) sendSessions(c *gin.Context, userID string) {
+	var refresh []models.RefreshToken
+	err := ctl.DB.Find(&refresh,
+		"userid = ? AND used = ? AND revoked = ? AND expires > ?",
+		userID, false, false, time.Now()).Error
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	families := make([]string, 0)
+	for _, rt := range refresh {
+		families = append(families, rt.FamilyID)
+	}
+	var tokens []models.Token
+	if len(families) > 0 {
+		err = ctl.DB.Find(&tokens, "familyid IN ?", families).Error
+		if err != nil {
+			ctl.databaseError(c, err)
+			return
+		}
+	}
+	var current models.Token
+	if err = ctl.DB.Find(&current, "id = ?", ctl.tokenID(c)).Error; err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, models.BuildSessions(tokens, refresh,
+		current.FamilyID))
+}
+
+func (ctl *Controller) deleteSession(c *gin.Context, userID string,
+	family string) {
+	var count int64
+	err := ctl.DB.Model(&models.RefreshToken{}).
+		Where("userid = ? AND familyid = ?", userID, family).
+		Count(&count).Error
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	if count == 0 {
+		ctl.notFound(c, "session")
+		return
+	}
+	if err = ctl.revokeFamily(family); err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Session Revoked: %s for %s by %s", family,
+		userID, ctl.userID(c)))
+	c.Status(http.StatusNoContent)
+}
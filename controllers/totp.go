@@ -0,0 +1,272 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/antonerne/go-soap/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type totpStartResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// StartTOTP function will start the authorized user's two-factor enrollment,
+// providing the secret and the provisioning URI for their authenticator.
+func (ctl *Controller) StartTOTP(c *gin.Context) {
+	user, ok := ctl.loadUser(c, ctl.userID(c))
+	if !ok {
+		return
+	}
+	if user.Creds.TOTPEnabled {
+		ctl.sendError(c, &models.ErrorMessage{
+			ErrorType:  "two factor",
+			StatusCode: http.StatusConflict,
+			Message:    "Two-factor authentication is already enabled",
+		})
+		return
+	}
+	secret, err := user.Creds.StartTOTP()
+	if err != nil {
+		ctl.Log.WriteToLog(err.Error())
+		ctl.sendError(c, &models.ErrorMessage{
+			ErrorType:  "two factor",
+			StatusCode: http.StatusInternalServerError,
+			Message:    "secret creation failure",
+		})
+		return
+	}
+	err = ctl.saveCreds(&user.Creds, "totpsecret", "totpenabled",
+		"totplaststep")
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, totpStartResponse{
+		Secret: secret,
+		URI:    models.TOTPURI(secret, user.Email),
+	})
+}
+
+type totpCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// ConfirmTOTP function will enable two-factor authentication once the user
+// confirms a code from their authenticator, providing the user's recovery
+// codes.  The recovery codes are only shown this once.
+func (ctl *Controller) ConfirmTOTP(c *gin.Context) {
+	var req totpCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	user, ok := ctl.totpUser(c)
+	if !ok {
+		return
+	}
+	lockCount := user.Creds.LockCount
+	ok, errMsg := user.Creds.EnableTOTP(req.Code)
+	if !ctl.totpAttempt(c, user, lockCount, ok, errMsg) {
+		return
+	}
+	ctl.sendRecoveryCodes(c, &user.Creds)
+	ctl.Log.WriteToLog(fmt.Sprintf("Two-Factor Enabled: %s", ctl.userID(c)))
+}
+
+// RegenerateRecoveryCodes function will replace the authorized user's
+// recovery codes after checking a code from their authenticator.
+func (ctl *Controller) RegenerateRecoveryCodes(c *gin.Context) {
+	var req totpCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	user, ok := ctl.totpUser(c)
+	if !ok {
+		return
+	}
+	if !user.Creds.TOTPEnabled {
+		ctl.sendError(c, &models.ErrorMessage{
+			ErrorType:  "two factor",
+			StatusCode: http.StatusUnauthorized,
+			Message:    "Invalid Two-Factor Code",
+		})
+		return
+	}
+	lockCount := user.Creds.LockCount
+	ok, errMsg := user.Creds.CheckTOTPAttempt(req.Code)
+	if !ctl.totpAttempt(c, user, lockCount, ok, errMsg) {
+		return
+	}
+	ctl.sendRecoveryCodes(c, &user.Creds)
+}
+
+// totpUser function will load the authorized user with their credentials
+// for a change to their two-factor settings.
+func (ctl *Controller) totpUser(c *gin.Context) (*models.User, bool) {
+	user, err := ctl.loginUser("id = ?", ctl.userID(c))
+	if err != nil {
+		ctl.databaseError(c, err)
+		return nil, false
+	}
+	return user, true
+}
+
+// totpAttempt function will save the result of checking a code for a change
+// to the user's two-factor settings, sending the error to the client if the
+// code was wrong.  Wrong codes lock the account as they do at log in.
+func (ctl *Controller) totpAttempt(c *gin.Context, user *models.User,
+	lockCount int16, ok bool, errMsg *models.ErrorMessage) bool {
+	if err := ctl.saveAttempt(user, lockCount, "totplaststep"); err != nil {
+		ctl.databaseError(c, err)
+		return false
+	}
+	if !ok {
+		ctl.Log.WriteToLog(fmt.Sprintf("Two-Factor Failure: %s from %s - %s",
+			user.Email, c.ClientIP(), errMsg.String()))
+		ctl.sendError(c, errMsg)
+		return false
+	}
+	return true
+}
+
+type totpDisableRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+// DisableTOTP function will remove the authorized user's two-factor
+// authentication after checking their password.  Users with roles can't
+// remove it when the server requires it for them.
+func (ctl *Controller) DisableTOTP(c *gin.Context) {
+	var req totpDisableRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	user, ok := ctl.loadUser(c, ctl.userID(c))
+	if !ok {
+		return
+	}
+	if !ctl.checkCurrentPassword(c, user, req.Password, "Two-Factor Disable") {
+		return
+	}
+	if len(user.Roles) > 0 && models.RequireEditorTOTP {
+		ctl.sendError(c, &models.ErrorMessage{
+			ErrorType:  "two factor",
+			StatusCode: http.StatusForbidden,
+			Message:    "Two-factor authentication is required for users with roles",
+		})
+		return
+	}
+	user.Creds.DisableTOTP()
+	if err := ctl.saveTOTP(&user.Creds); err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Two-Factor Disabled: %s", user.Email))
+	c.Status(http.StatusNoContent)
+}
+
+// ResetUserTOTP function will allow an editor to remove the two-factor
+// authentication of a user who has lost their authenticator and recovery
+// codes.
+func (ctl *Controller) ResetUserTOTP(c *gin.Context) {
+	user, ok := ctl.loadUser(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	user.Creds.DisableTOTP()
+	err := ctl.audited(c, user, models.AuditTOTPReset, "",
+		func(tx *gorm.DB) error {
+			return updateTOTP(tx, &user.Creds)
+		})
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Two-Factor Reset: %s by %s", user.Email,
+		ctl.userID(c)))
+	c.Status(http.StatusNoContent)
+}
+
+// checkSecondFactor function will check the TOTP or recovery code given at
+// log in for users with two-factor authentication enabled, sending the error
+// to the client if it fails.
+func (ctl *Controller) checkSecondFactor(c *gin.Context, user *models.User,
+	code string) bool {
+	if !user.Creds.TOTPEnabled {
+		return true
+	}
+	lockCount := user.Creds.LockCount
+	ok, used, errMsg := user.Creds.VerifySecondFactor(code)
+	err := ctl.saveAttempt(user, lockCount, "totplaststep")
+	if err == nil && used != nil {
+		err = ctl.DB.Model(used).Update("used", true).Error
+	}
+	if err != nil {
+		ctl.databaseError(c, err)
+		return false
+	}
+	if !ok {
+		ctl.Log.WriteToLog(fmt.Sprintf("Two-Factor Failure: %s from %s - %s",
+			user.Email, c.ClientIP(), errMsg.String()))
+		ctl.sendError(c, errMsg)
+		return false
+	}
+	if used != nil {
+		ctl.Log.WriteToLog(fmt.Sprintf("Recovery Code Used: %s", user.Email))
+	}
+	return true
+}
+
+func (ctl *Controller) sendRecoveryCodes(c *gin.Context,
+	creds *models.Credentials) {
+	codes, err := creds.NewRecoveryCodes()
+	if err != nil {
+		ctl.Log.WriteToLog(err.Error())
+		ctl.sendError(c, &models.ErrorMessage{
+			ErrorType:  "two factor",
+			StatusCode: http.StatusInternalServerError,
+			Message:    "recovery code creation failure",
+		})
+		return
+	}
+	if err = ctl.saveTOTP(creds); err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, recoveryCodesResponse{
+		RecoveryCodes: codes,
+	})
+}
+
+// saveTOTP function will save the credentials' two-factor fields, replacing
+// the stored recovery codes with the credentials' codes.
+func (ctl *Controller) saveTOTP(creds *models.Credentials) error {
+	return ctl.DB.Transaction(func(tx *gorm.DB) error {
+		return updateTOTP(tx, creds)
+	})
+}
+
+func updateTOTP(tx *gorm.DB, creds *models.Credentials) error {
+	err := tx.Model(creds).
+		Select("totpsecret", "totpenabled", "totplaststep").
+		Updates(creds).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Delete(&models.TOTPRecoveryCode{}, "userid = ?",
+		creds.UserID).Error
+	if err != nil || len(creds.RecoveryCodes) == 0 {
+		return err
+	}
+	return tx.Create(&creds.RecoveryCodes).Error
+}
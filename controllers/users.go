@@ -0,0 +1,454 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/antonerne/go-soap/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// GetCurrentUser function will provide the authorized user's account.
+func (ctl *Controller) GetCurrentUser(c *gin.Context) {
+	user, ok := ctl.loadUser(c, ctl.userID(c))
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// GetUsers function will provide a page of the users, ordered by name.  The
+// q parameter searches the email addresses and names, role limits the list
+// to the users with the role, and status to the locked, pending or
+// unverified accounts.
+func (ctl *Controller) GetUsers(c *gin.Context) {
+	query := ctl.DB.Model(&models.User{}).
+		Joins("LEFT JOIN user_names ON user_names.userid = users.id").
+		Joins("LEFT JOIN user_credentials ON user_credentials.userid = users.id")
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`,
+			"_", `\_`).Replace(strings.ToLower(q)) + "%"
+		query = query.Where("LOWER(users.email) LIKE ? OR "+
+			"LOWER(user_names.first) LIKE ? OR LOWER(user_names.last) LIKE ?",
+			pattern, pattern, pattern)
+	}
+	if role := c.Query("role"); role != "" {
+		query = query.Where("users.id IN (SELECT userid FROM user_roles "+
+			"WHERE role = ?)", role)
+	}
+	switch c.Query("status") {
+	case "":
+	case "locked":
+		query = query.Where("user_credentials.locked = ? AND "+
+			"(user_credentials.lockeduntil <= ? OR user_credentials.lockeduntil > ?)",
+			true, time.Time{}, time.Now())
+	case "pending":
+		query = query.Where("user_credentials.pending = ?", true)
+	case "unverified":
+		query = query.Where("user_credentials.verified < ?",
+			time.Date(1970, time.January, 2, 0, 0, 0, 0, time.UTC))
+	default:
+		ctl.badRequest(c, errors.New("status must be locked, pending or "+
+			"unverified"))
+		return
+	}
+	query, page, ok := ctl.paginate(c, query)
+	if !ok {
+		return
+	}
+	users := make([]models.User, 0)
+	err := query.Preload("Name").Preload("Creds").Preload("Roles").
+		Order("user_names.last, user_names.first, users.email").
+		Find(&users).Error
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	page.Items = users
+	c.JSON(http.StatusOK, page)
+}
+
+func (ctl *Controller) GetUser(c *gin.Context) {
+	user, ok := ctl.loadUser(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// UpdateUser function will allow an editor to change a user's email address
+// and name.  The email address of a user with permissions the editor doesn't
+// have can't be changed.
+func (ctl *Controller) UpdateUser(c *gin.Context) {
+	var req models.AccountUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	if errMsg := req.Validate(); errMsg != nil {
+		ctl.sendError(c, errMsg)
+		return
+	}
+	user, ok := ctl.loadUser(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if !strings.EqualFold(user.Email, req.Email) {
+		var count int64
+		err := ctl.DB.Model(&models.User{}).
+			Where("LOWER(email) = ? AND id <> ?", strings.ToLower(req.Email),
+				user.ID).
+			Count(&count).Error
+		if err != nil {
+			ctl.databaseError(c, err)
+			return
+		}
+		if count > 0 {
+			ctl.sendError(c, &models.ErrorMessage{
+				ErrorType:  "user",
+				StatusCode: http.StatusConflict,
+				Message:    "Email address already registered",
+			})
+			return
+		}
+		// the email address lets its owner reset the password, so only
+		// users with all of the account's permissions may change it.
+		if !ctl.outranks(c, user) {
+			return
+		}
+	}
+	changes := req.Apply(user)
+	if changes == "" {
+		c.JSON(http.StatusOK, user)
+		return
+	}
+	err := ctl.audited(c, user, models.AuditUserUpdated, changes,
+		func(tx *gorm.DB) error {
+			err := tx.Model(user).Update("email", user.Email).Error
+			if err != nil {
+				return err
+			}
+			return tx.Model(&user.Name).
+				Select("first", "middle", "last", "suffix").
+				Updates(&user.Name).Error
+		})
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Account Updated: %s by %s - %s",
+		user.Email, ctl.userID(c), changes))
+	c.JSON(http.StatusOK, user)
+}
+
+// ForcePasswordChange function will require a user to change their
+// password at their next log in.  Their sessions end at once, and until the
+// password is changed they can only see their account, change the password
+// and sign out.
+func (ctl *Controller) ForcePasswordChange(c *gin.Context) {
+	user, ok := ctl.loadUser(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	user.Creds.MustChange = true
+	err := ctl.audited(c, user, models.AuditMustChange, "",
+		func(tx *gorm.DB) error {
+			err := tx.Model(&user.Creds).Update("mustchange", true).Error
+			if err != nil {
+				return err
+			}
+			return revokeTokens(tx, user.ID)
+		})
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Password Change Required: %s by %s",
+		user.Email, ctl.userID(c)))
+	c.JSON(http.StatusOK, user)
+}
+
+type lockRequest struct {
+	Reason string `json:"reason"`
+}
+
+// LockUser function will allow an editor to disable an account until it is
+// unlocked.  The user's sessions and API keys stop working at once.  The last
+// editor can't be locked.
+func (ctl *Controller) LockUser(c *gin.Context) {
+	var req lockRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		ctl.badRequest(c, err)
+		return
+	}
+	user, ok := ctl.adminTarget(c)
+	if !ok || !ctl.keepEditor(c, user, "locked") {
+		return
+	}
+	user.Creds.Disable()
+	err := ctl.audited(c, user, models.AuditUserLocked,
+		strings.TrimSpace(req.Reason), func(tx *gorm.DB) error {
+			err := tx.Model(&user.Creds).
+				Select("badattempts", "locked", "lockeduntil").
+				Updates(&user.Creds).Error
+			if err != nil {
+				return err
+			}
+			return revokeTokens(tx, user.ID)
+		})
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Account Disabled: %s by %s", user.Email,
+		ctl.userID(c)))
+	c.JSON(http.StatusOK, user)
+}
+
+// UnlockUser function will allow an administrator to unlock an account before its
+// lock period has passed, or one locked without an end.
+func (ctl *Controller) UnlockUser(c *gin.Context) {
+	user, ok := ctl.loadUser(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	user.Creds.Unlock()
+	err := ctl.audited(c, user, models.AuditUserUnlocked, "",
+		func(tx *gorm.DB) error {
+			return tx.Model(&user.Creds).
+				Select("badattempts", "locked", "lockeduntil", "lockcount").
+				Updates(&user.Creds).Error
+		})
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Account Unlocked: %s by %s", user.Email,
+		ctl.userID(c)))
+	c.JSON(http.StatusOK, user)
+}
+
+// DeleteUser function will remove a user's account.  The account is only
+// marked as deleted, but the user's roles, passkeys, linked accounts, API
+// keys and sessions are removed so the account can't be used.  The last
+// editor can't be removed.
+func (ctl *Controller) DeleteUser(c *gin.Context) {
+	user, ok := ctl.adminTarget(c)
+	if !ok || !ctl.keepEditor(c, user, "removed") {
+		return
+	}
+	err := ctl.audited(c, user, models.AuditUserDeleted,
+		strings.Join(user.RoleNames(), " "), func(tx *gorm.DB) error {
+			for _, item := range []interface{}{&models.UserRole{},
+				&models.WebAuthnCredential{}, &models.OIDCLink{},
+				&models.APIKey{}} {
+				if err := tx.Delete(item, "userid = ?", user.ID).Error; err != nil {
+					return err
+				}
+			}
+			if err := revokeTokens(tx, user.ID); err != nil {
+				return err
+			}
+			return tx.Delete(user).Error
+		})
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Account Removed: %s by %s", user.Email,
+		ctl.userID(c)))
+	c.Status(http.StatusNoContent)
+}
+
+// adminTarget function will load the user an editor is disabling or
+// removing, refusing the editor's own account.
+func (ctl *Controller) adminTarget(c *gin.Context) (*models.User, bool) {
+	if c.Param("id") == ctl.userID(c) {
+		ctl.sendError(c, &models.ErrorMessage{
+			ErrorType:  "user",
+			StatusCode: http.StatusConflict,
+			Message:    "You can't disable or remove your own account",
+		})
+		return nil, false
+	}
+	return ctl.loadUser(c, c.Param("id"))
+}
+
+// keepEditor function will refuse to lock or remove the user when no other
+// editor could still sign in, so the accounts can always be managed.
+func (ctl *Controller) keepEditor(c *gin.Context, user *models.User,
+	action string) bool {
+	if !user.HasRole(models.RoleEditor) {
+		return true
+	}
+	var count int64
+	err := ctl.DB.Model(&models.UserRole{}).
+		Joins("JOIN user_credentials ON user_credentials.userid = user_roles.userid").
+		Where("user_roles.role = ? AND user_roles.userid <> ?",
+			models.RoleEditor, user.ID).
+		Where("(user_credentials.locked = ? OR user_credentials.lockeduntil > ?)",
+			false, time.Time{}).
+		Count(&count).Error
+	if err != nil {
+		ctl.databaseError(c, err)
+		return false
+	}
+	if count == 0 {
+		ctl.sendError(c, &models.ErrorMessage{
+			ErrorType:  "user",
+			StatusCode: http.StatusConflict,
+			Message:    "The last editor can't be " + action,
+		})
+		return false
+	}
+	return true
+}
+
+// outranks function will report if the authorized user has every permission
+// the user's roles grant, sending the error to the client if not.
+func (ctl *Controller) outranks(c *gin.Context, user *models.User) bool {
+	own, err := ctl.userPermissions(ctl.userID(c))
+	if err != nil {
+		ctl.databaseError(c, err)
+		return false
+	}
+	theirs, err := ctl.userPermissions(user.ID)
+	if err != nil {
+		ctl.databaseError(c, err)
+		return false
+	}
+	granted := make(map[string]bool)
+	for _, perm := range own {
+		granted[perm] = true
+	}
+	for _, perm := range theirs {
+		if !granted[perm] {
+			ctl.Log.WriteToLog(fmt.Sprintf("Permission Denied: %s - change "+
+				"of %s with %s", ctl.userID(c), user.Email, perm))
+			ctl.sendError(c, &models.ErrorMessage{
+				ErrorType:  "authorization",
+				StatusCode: http.StatusForbidden,
+				Message:    "Permission Denied",
+				Details:    []string{perm},
+			})
+			return false
+		}
+	}
+	return true
+}
+
+// userPermissions function will provide the permissions the user's roles
+// grant.
+func (ctl *Controller) userPermissions(userID string) ([]string, error) {
+	perms := make([]string, 0)
+	err := ctl.DB.Table("user_roles").
+		Joins("JOIN role_permissions ON role_permissions.role = user_roles.role").
+		Where("user_roles.userid = ?", userID).
+		Pluck("role_permissions.permission", &perms).Error
+	return perms, err
+}
+
+// GetUserStudies function will provide the bible studies the authorized user
+// has started, with their periods, days and references in order.
+func (ctl *Controller) GetUserStudies(c *gin.Context) {
+	ctl.sendUserStudies(c, ctl.userID(c))
+}
+
+// GetMemberStudies function will provide a member's bible studies, so a
+// group leader can follow the member's progress.
+func (ctl *Controller) GetMemberStudies(c *gin.Context) {
+	user, ok := ctl.loadUser(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	ctl.sendUserStudies(c, user.ID)
+}
+
+func (ctl *Controller) sendUserStudies(c *gin.Context, userID string) {
+	var studies []models.UserBibleStudy
+	err := ctl.DB.Preload("Periods.StudyDays.References").
+		Find(&studies, "userid = ?", userID).Error
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	sort.Sort(models.ByUserBibleStudy(studies))
+	for i := range studies {
+		sortUserStudy(&studies[i])
+	}
+	c.JSON(http.StatusOK, studies)
+}
+
+type startStudyRequest struct {
+	BibleStudyID uint64 `json:"bible_study_id" binding:"required"`
+}
+
+// StartUserStudy function will copy a bible study's plan for the authorized
+// user, starting today.
+func (ctl *Controller) StartUserStudy(c *gin.Context) {
+	var req startStudyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	study, ok := ctl.loadBibleStudy(c, req.BibleStudyID)
+	if !ok {
+		return
+	}
+	var userStudy models.UserBibleStudy
+	userStudy.SetNew(ctl.userID(c), *study, ctl.DB)
+	if userStudy.ID == 0 {
+		ctl.databaseError(c, errors.New("user study not created"))
+		return
+	}
+	c.JSON(http.StatusCreated, userStudy)
+}
+
+func (ctl *Controller) DeleteUserStudy(c *gin.Context) {
+	id, ok := ctl.paramID(c, "id")
+	if !ok {
+		return
+	}
+	result := ctl.DB.Where("userid = ?", ctl.userID(c)).
+		Delete(&models.UserBibleStudy{}, id)
+	if result.Error != nil {
+		ctl.databaseError(c, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		ctl.notFound(c, "user study")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (ctl *Controller) loadUser(c *gin.Context, id string) (*models.User, bool) {
+	var user models.User
+	err := ctl.DB.Preload("Name").Preload("Creds.Remotes").
+		Preload("Creds.Passkeys").Preload("Roles").
+		First(&user, "id = ?", id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		ctl.notFound(c, "user")
+		return nil, false
+	} else if err != nil {
+		ctl.databaseError(c, err)
+		return nil, false
+	}
+	return &user, true
+}
+
+func sortUserStudy(study *models.UserBibleStudy) {
+	sort.Sort(models.ByUserBibleStudyPeriod(study.Periods))
+	for _, period := range study.Periods {
+		sort.Sort(models.ByUserBibleStudyDay(period.StudyDays))
+		for _, day := range period.StudyDays {
+			sort.Sort(models.ByUserBibleStudyReference(day.References))
+		}
+	}
+}
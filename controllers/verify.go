@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/antonerne/go-soap/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type verifyRequest struct {
+	Email string `json:"email" binding:"required"`
+	Token string `json:"token" binding:"required"`
+}
+
+// VerifyEmail function will complete the email verification process with the
+// token sent to the user, then welcome the user.
+func (ctl *Controller) VerifyEmail(c *gin.Context) {
+	var req verifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	user, ok := ctl.findUserByEmail(c, req.Email)
+	if !ok {
+		return
+	}
+
+	ok, errMsg := user.Creds.Verify(req.Token)
+	err := ctl.saveCreds(&user.Creds, "verified", "verificationtoken",
+		"verificationexpires", "verificationattempts")
+	if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	if !ok {
+		ctl.Log.WriteToLog(fmt.Sprintf("Verification Failure: %s from %s",
+			user.Email, c.ClientIP()))
+		ctl.sendError(c, errMsg)
+		return
+	}
+	if err = ctl.Notifier.SendWelcome(user); err != nil {
+		ctl.Log.WriteToLog(fmt.Sprintf("Welcome Not Sent: %s - %s",
+			user.Email, err.Error()))
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Verified: %s", user.Email))
+	c.Status(http.StatusNoContent)
+}
+
+type resendRequest struct {
+	Email string `json:"email" binding:"required"`
+}
+
+// ResendVerification function will send the user a new verification token,
+// no more often than models.VerificationResendWait.  The response is the same
+// whether or not the email address has an account or is already verified.
+func (ctl *Controller) ResendVerification(c *gin.Context) {
+	var req resendRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		ctl.badRequest(c, err)
+		return
+	}
+	user, err := ctl.lookupUser(req.Email)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.Status(http.StatusAccepted)
+		return
+	} else if err != nil {
+		ctl.databaseError(c, err)
+		return
+	}
+	if user.Creds.IsVerified() {
+		c.Status(http.StatusAccepted)
+		return
+	}
+	if !user.Creds.CanResendVerification() {
+		ctl.sendError(c, &models.ErrorMessage{
+			ErrorType:  "verification",
+			StatusCode: http.StatusTooManyRequests,
+			Message:    "Please wait before requesting another code",
+		})
+		return
+	}
+
+	ctl.sendVerification(user)
+	c.Status(http.StatusAccepted)
+}
+
+// sendVerification function will start the user's email verification and
+// send the token, logging any failure.
+func (ctl *Controller) sendVerification(user *models.User) {
+	code := user.Creds.StartVerification()
+	err := ctl.saveCreds(&user.Creds, "verified", "verificationtoken",
+		"verificationsent", "verificationexpires", "verificationattempts")
+	if err == nil {
+		err = ctl.Notifier.SendVerification(user, code,
+			user.Creds.VerificationExpires)
+	}
+	if err != nil {
+		ctl.Log.WriteToLog(fmt.Sprintf("Verification Not Sent: %s - %s",
+			user.Email, err.Error()))
+		return
+	}
+	ctl.Log.WriteToLog(fmt.Sprintf("Verification Sent: %s", user.Email))
+}
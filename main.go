@@ -2,13 +2,18 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/antonerne/go-soap/controllers"
 	"github.com/antonerne/go-soap/models"
+	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 
 	"github.com/joho/godotenv"
@@ -28,10 +33,13 @@ type Study struct {
 func main() {
 	progArgs := os.Args
 	loadData := false
+	serve := false
 	if len(progArgs) > 1 {
 		if strings.ToLower(progArgs[1]) == "true" ||
 			strings.ToLower(progArgs[1]) == "process" {
 			loadData = true
+		} else if strings.ToLower(progArgs[1]) == "serve" {
+			serve = true
 		}
 	}
 	err := godotenv.Load()
@@ -59,7 +67,20 @@ func main() {
 		&models.UserRemote{},
 		&models.Name{},
 		&models.Credentials{},
+		&models.PasswordHistory{},
+		&models.TOTPRecoveryCode{},
+		&models.WebAuthnCredential{},
+		&models.WebAuthnChallenge{},
+		&models.OIDCLink{},
+		&models.OIDCState{},
 		&models.Token{},
+		&models.RefreshToken{},
+		&models.APIKey{},
+		&models.Invite{},
+		&models.Role{},
+		&models.RolePermission{},
+		&models.UserRole{},
+		&models.AuditEntry{},
 	)
 
 	db.AutoMigrate(
@@ -69,9 +90,14 @@ func main() {
 		&models.UserBibleStudyReference{},
 	)
 
+	db.AutoMigrate(
+		&models.Entry{},
+		&models.EntryReference{},
+		&models.EntryText{},
+	)
+
 	if loadData {
 
-		db.Exec("DELETE FROM users")
 		db.Exec("DELETE FROM biblebooks")
 		db.Exec("DELETE FROM biblestudies")
 
@@ -92,12 +118,24 @@ func main() {
 
 		bookMap := make(map[uint]models.BibleBook)
 
+		// the users are only added if their email address isn't used, so
+		// loading the data again keeps the accounts made since.
 		for _, user := range users.Users {
+			var count int64
+			err = db.Model(&models.User{}).Unscoped().
+				Where("LOWER(email) = ?", strings.ToLower(user.Email)).
+				Count(&count).Error
+			if err != nil {
+				log.Fatal(err)
+			}
+			if count > 0 {
+				log.Printf("Skipping existing user %s", user.Email)
+				continue
+			}
 			user.ID = uuid.NewString()
 			user.Name.UserID = user.ID
 			user.Creds.UserID = user.ID
-			user.Creds.SetPassword("InitialPassword")
-			user.Creds.MustChange = true
+			user.Creds.SetTemporaryPassword("InitialPassword")
 			user.Creds.Locked = false
 			db.Create(&user)
 		}
@@ -126,4 +164,180 @@ func main() {
 			db.Create(&st)
 		}
 	}
+
+	if err = models.SetupRoles(db); err != nil {
+		log.Fatal(err)
+	}
+
+	if serve {
+		logDir := os.Getenv("LOGDIR")
+		if logDir == "" {
+			logDir = "logs"
+		}
+		err = os.MkdirAll(logDir, 0755)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logFile := &models.LogFile{
+			Directory: logDir,
+			FileType:  "soap",
+		}
+
+		port := os.Getenv("PORT")
+		if port == "" {
+			port = "8080"
+		}
+
+		if err = loadSigningKeys(models.Keys); err != nil {
+			log.Fatal(err)
+		}
+		if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+			models.TokenIssuer = issuer
+		}
+		if audience := os.Getenv("JWT_AUDIENCE"); audience != "" {
+			models.TokenAudience = audience
+		}
+		if minutes := envInt("JWT_ACCESS_MINUTES"); minutes > 0 {
+			models.AccessTokenLife = time.Minute * time.Duration(minutes)
+		}
+		if days := envInt("JWT_REFRESH_DAYS"); days > 0 {
+			models.RefreshTokenLife = time.Hour * 24 * time.Duration(days)
+		}
+		if minutes := envInt("JOURNAL_KEY_MINUTES"); minutes > 0 {
+			models.SessionKeyLife = time.Minute * time.Duration(minutes)
+		}
+
+		if length := envInt("PASSWORD_MIN_LENGTH"); length > 0 {
+			models.Passwords.MinLength = length
+		}
+		if classes := envInt("PASSWORD_MIN_CLASSES"); classes > 0 {
+			models.Passwords.MinClasses = classes
+		}
+		if history := envInt("PASSWORD_HISTORY"); history > 0 {
+			models.Passwords.History = history
+		}
+		if cost := envInt("BCRYPT_COST"); cost > 0 {
+			models.Passwords.Cost = cost
+		}
+		if common := os.Getenv("PASSWORD_COMMON_FILE"); common != "" {
+			err = models.Passwords.LoadCommon(common)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if threshold := envInt("LOCKOUT_THRESHOLD"); threshold > 0 {
+			models.Lockout.Threshold = int16(threshold)
+		}
+		if minutes := envInt("LOCKOUT_MINUTES"); minutes > 0 {
+			models.Lockout.Duration = time.Minute * time.Duration(minutes)
+		}
+		if minutes := envInt("LOCKOUT_MAX_MINUTES"); minutes > 0 {
+			models.Lockout.MaxDuration = time.Minute * time.Duration(minutes)
+		}
+		if strings.ToLower(os.Getenv("REQUIRE_EDITOR_2FA")) == "true" {
+			models.RequireEditorTOTP = true
+		}
+		if rpID := os.Getenv("WEBAUTHN_RPID"); rpID != "" {
+			models.WebAuthnRPID = rpID
+			models.WebAuthnOrigins = []string{"https://" + rpID}
+		}
+		if origins := envList("WEBAUTHN_ORIGINS"); len(origins) > 0 {
+			models.WebAuthnOrigins = origins
+		}
+		if mode := strings.ToLower(os.Getenv("REGISTRATION_MODE")); mode != "" {
+			models.RegistrationMode = mode
+		}
+		if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+			models.OIDC = models.NewOIDCProvider(issuer,
+				os.Getenv("OIDC_CLIENT_ID"), os.Getenv("OIDC_CLIENT_SECRET"),
+				os.Getenv("OIDC_REDIRECT_URL"))
+			if scopes := envList("OIDC_SCOPES"); len(scopes) > 0 {
+				models.OIDC.Scopes = scopes
+			}
+			models.OIDCProvision =
+				strings.ToLower(os.Getenv("OIDC_PROVISION")) == "true"
+		}
+
+		router := gin.Default()
+		mailFrom := os.Getenv("MAIL_FROM")
+		if mailFrom == "" {
+			mailFrom = "SOAP Journal <noreply@localhost>"
+		}
+		var mailer models.Mailer
+		if strings.ToLower(os.Getenv("MAIL_BACKEND")) == "smtp" {
+			mailer = &models.SMTPMailer{
+				Host:     os.Getenv("SMTP_HOST"),
+				Port:     os.Getenv("SMTP_PORT"),
+				Username: os.Getenv("SMTP_USER"),
+				Password: os.Getenv("SMTP_PASSWORD"),
+				From:     mailFrom,
+			}
+		} else {
+			outbox := os.Getenv("MAIL_OUTBOX")
+			if outbox == "" {
+				outbox = "outbox"
+			}
+			mailer = &models.OutboxMailer{
+				Directory: outbox,
+				From:      mailFrom,
+			}
+		}
+		notifier := &models.MailNotifier{Mailer: mailer}
+		ctl := controllers.NewController(db, logFile, notifier)
+		ctl.Routes(router)
+		logFile.WriteToLog("Server starting on port " + port)
+		log.Fatal(router.Run(":" + port))
+	}
+}
+
+// envInt function will provide the numeric value of the environment
+// variable, or zero if it isn't set or isn't a number.
+func envInt(name string) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return 0
+	}
+	return value
+}
+
+// loadSigningKeys function will set up the keys for the access tokens.  New
+// tokens are signed with the RSA or Ed25519 key in JWT_KEY_FILE, or with the
+// JWT_SECRET if no key file is given.  The keys used before a rotation are
+// given in JWT_PREVIOUS_KEY_FILES and JWT_PREVIOUS_SECRETS, so the tokens
+// they signed are accepted until they expire.
+func loadSigningKeys(keys *models.KeyManager) error {
+	for _, path := range envList("JWT_PREVIOUS_KEY_FILES") {
+		key, err := models.LoadKeyFile(path)
+		if err != nil {
+			return err
+		}
+		keys.AddVerificationKey(key)
+	}
+	for _, secret := range envList("JWT_PREVIOUS_SECRETS") {
+		keys.AddVerificationKey(models.NewHMACKey([]byte(secret)))
+	}
+	if path := os.Getenv("JWT_KEY_FILE"); path != "" {
+		key, err := models.LoadKeyFile(path)
+		if err != nil {
+			return err
+		}
+		return keys.SetSigningKey(key)
+	}
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		return errors.New("JWT_KEY_FILE or JWT_SECRET must be set")
+	}
+	return keys.SetSigningKey(models.NewHMACKey([]byte(secret)))
+}
+
+// envList function will provide the comma separated values of the
+// environment variable, or an empty list if it isn't set.
+func envList(name string) []string {
+	values := make([]string, 0)
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
 }
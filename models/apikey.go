@@ -0,0 +1,166 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// APIKeyPrefix starts every API key, so the middleware can tell the keys
+// from access tokens and secret scanners can find leaked keys.
+const APIKeyPrefix = "soap_"
+
+// The scopes an API key can be given.  A read key can only make GET
+// requests, a write key can make any request the user can, and the admin
+// scope is needed to use the user's role permissions.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+// APIKeyLife provides how long an API key is valid when no expiration is
+// given, APIKeyMaxLife the longest expiration allowed, and APIKeyLimit the
+// number of keys a user can have.
+var (
+	APIKeyLife    = time.Hour * 24 * 90
+	APIKeyMaxLife = time.Hour * 24 * 365
+	APIKeyLimit   = 20
+)
+
+// APIKey is a named key a user creates for scripts and tools that can't log
+// in.  Only a hash of the key's secret is stored, so the key is only shown
+// when it is created.
+type APIKey struct {
+	ID         string    `json:"id" gorm:"primaryKey;column:id"`
+	UserID     string    `json:"-" gorm:"column:userid;index"`
+	Name       string    `json:"name" gorm:"column:name"`
+	Secret     string    `json:"-" gorm:"column:secret"`
+	Scopes     string    `json:"scopes" gorm:"column:scopes"`
+	Created    time.Time `json:"created" gorm:"column:created"`
+	Expires    time.Time `json:"expires" gorm:"column:expires"`
+	LastUsed   time.Time `json:"lastused" gorm:"column:lastused"`
+	LastUsedIP string    `json:"lastused_ip" gorm:"column:lastusedip"`
+}
+
+func (APIKey) TableName() string {
+	return "user_api_keys"
+}
+
+// NewAPIKey function will create the user's API key with the scopes, which
+// expires after the number of days given or APIKeyLife.  The encoded key
+// returned is the value given to the user, it is not stored.
+func NewAPIKey(userID string, name string, scopes []string,
+	days int) (*APIKey, string, *ErrorMessage) {
+	details := make([]string, 0)
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 64 {
+		details = append(details, "Name must be 1 to 64 characters")
+	}
+	life := APIKeyLife
+	if days > 0 {
+		life = time.Hour * 24 * time.Duration(days)
+	}
+	if days < 0 || life > APIKeyMaxLife {
+		details = append(details, fmt.Sprintf(
+			"Expiration must be at most %d days",
+			int(APIKeyMaxLife.Hours()/24)))
+	}
+	scopeSet := make(map[string]bool)
+	for _, scope := range scopes {
+		switch scope {
+		case ScopeRead, ScopeWrite, ScopeAdmin:
+			scopeSet[scope] = true
+		default:
+			details = append(details, fmt.Sprintf("Unknown scope %s", scope))
+		}
+	}
+	if len(scopeSet) == 0 {
+		details = append(details, "At least one scope is required")
+	}
+	if len(details) > 0 {
+		return nil, "", &ErrorMessage{
+			ErrorType:  "api key",
+			StatusCode: http.StatusBadRequest,
+			Message:    "Invalid API key request",
+			Details:    details,
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", &ErrorMessage{
+			ErrorType:  "api key",
+			StatusCode: http.StatusInternalServerError,
+			Message:    "api key creation failure",
+		}
+	}
+	list := make([]string, 0)
+	for scope := range scopeSet {
+		list = append(list, scope)
+	}
+	sort.Strings(list)
+	encodedSecret := base64.RawURLEncoding.EncodeToString(secret)
+	key := &APIKey{
+		ID:      strings.ReplaceAll(uuid.NewString(), "-", ""),
+		UserID:  userID,
+		Name:    name,
+		Secret:  hashSecret(encodedSecret),
+		Scopes:  strings.Join(list, " "),
+		Created: time.Now(),
+		Expires: time.Now().Add(life),
+	}
+	return key, APIKeyPrefix + key.ID + "." + encodedSecret, nil
+}
+
+// IsAPIKey function will report if the bearer credential is an API key
+// rather than an access token.
+func IsAPIKey(encoded string) bool {
+	return strings.HasPrefix(encoded, APIKeyPrefix)
+}
+
+// ParseAPIKey function will separate the encoded key into the key's
+// identifier and secret.
+func ParseAPIKey(encoded string) (string, string, error) {
+	if !IsAPIKey(encoded) {
+		return "", "", errors.New("invalid api key")
+	}
+	parts := strings.SplitN(strings.TrimPrefix(encoded, APIKeyPrefix), ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New("invalid api key")
+	}
+	return parts[0], parts[1], nil
+}
+
+// Matches function will compare the secret with the stored hash in constant
+// time.
+func (k *APIKey) Matches(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(k.Secret),
+		[]byte(hashSecret(secret))) == 1
+}
+
+// HasScope function will report if the key was given the scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range strings.Fields(k.Scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows function will report if the key's scopes allow the request method.
+func (k *APIKey) Allows(method string) bool {
+	if method == http.MethodGet || method == http.MethodHead {
+		return k.HasScope(ScopeRead) || k.HasScope(ScopeWrite)
+	}
+	return k.HasScope(ScopeWrite)
+}
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"time"
+)
+
+// The actions recorded in the audit log.
+const (
+	AuditUserUpdated  = "user.update"
+	AuditMustChange   = "user.mustchange"
+	AuditUserLocked   = "user.lock"
+	AuditUserUnlocked = "user.unlock"
+	AuditUserDeleted  = "user.delete"
+	AuditTOTPReset    = "user.totp.reset"
+	AuditRoleAdded    = "user.role.add"
+	AuditRoleRemoved  = "user.role.remove"
+)
+
+// AuditEntry records a change an editor made to a user's account, with who
+// made it and from where.  The target's email address is kept with the
+// entry, so it can still be read after the account is removed.
+type AuditEntry struct {
+	ID          uint64    `json:"id" gorm:"primaryKey;column:id;autoIncrement"`
+	ActorID     string    `json:"actor" gorm:"column:actorid;index"`
+	TargetID    string    `json:"target" gorm:"column:targetid;index"`
+	TargetEmail string    `json:"target_email" gorm:"column:targetemail"`
+	Action      string    `json:"action" gorm:"column:action;index"`
+	Details     string    `json:"details,omitempty" gorm:"column:details"`
+	RemoteIP    string    `json:"remote_ip" gorm:"column:remoteip"`
+	Created     time.Time `json:"created" gorm:"column:created;index"`
+}
+
+func (AuditEntry) TableName() string {
+	return "audit_log"
+}
+
+// NewAuditEntry function will create the audit log entry for the action the
+// actor took on the user's account.
+func NewAuditEntry(actorID string, target *User, action string,
+	details string, remote string) *AuditEntry {
+	return &AuditEntry{
+		ActorID:     actorID,
+		TargetID:    target.ID,
+		TargetEmail: target.Email,
+		Action:      action,
+		Details:     details,
+		RemoteIP:    remote,
+		Created:     time.Now(),
+	}
+}
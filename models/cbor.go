@@ -0,0 +1,125 @@
+package models
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var errCBOR = errors.New("invalid cbor data")
+
+// decodeCBOR function will decode the first CBOR item in the data, returning
+// the item and the data after it.  Only the subset of CBOR used by WebAuthn
+// authenticators is supported: integers, byte and text strings, arrays, maps
+// with integer or text keys, tags and the simple values.  Integers are given
+// as int64, maps as map[interface{}]interface{} and arrays as []interface{}.
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > 16 || len(data) == 0 {
+		return nil, nil, errCBOR
+	}
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < size {
+			return nil, nil, errCBOR
+		}
+		switch size {
+		case 1:
+			arg = uint64(data[0])
+		case 2:
+			arg = uint64(binary.BigEndian.Uint16(data))
+		case 4:
+			arg = uint64(binary.BigEndian.Uint32(data))
+		default:
+			arg = binary.BigEndian.Uint64(data)
+		}
+		data = data[size:]
+	default:
+		// indefinite lengths aren't used by authenticators.
+		return nil, nil, errCBOR
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+		return int64(arg), data, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+		return -1 - int64(arg), data, nil
+	case 2, 3:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCBOR
+		}
+		if major == 3 {
+			return string(data[:arg]), data[arg:], nil
+		}
+		value := make([]byte, arg)
+		copy(value, data)
+		return value, data[arg:], nil
+	case 4:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCBOR
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			item, rest, err := decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+			data = rest
+		}
+		return items, data, nil
+	case 5:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCBOR
+		}
+		items := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			key, rest, err := decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errCBOR
+			}
+			value, rest, err := decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items[key] = value
+			data = rest
+		}
+		return items, data, nil
+	case 6:
+		return decodeCBORItem(data, depth+1)
+	default:
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		}
+		// floating point values aren't used by authenticators.
+		return nil, nil, errCBOR
+	}
+}
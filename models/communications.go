@@ -4,31 +4,44 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/golang-jwt/jwt/v4"
 )
 
 type ErrorMessage struct {
-	ErrorType  string `json:"errortype"`
-	StatusCode int32  `json:"status"`
-	Message    string `json:"message"`
+	ErrorType  string   `json:"errortype"`
+	StatusCode int32    `json:"status"`
+	Message    string   `json:"message"`
+	Details    []string `json:"details,omitempty"`
 }
 
 func (em *ErrorMessage) String() string {
 	return fmt.Sprintf("(%s) %s", em.ErrorType, em.Message)
 }
 
+// JwtClaims provides the claims in the access tokens.  The token's
+// expiration, issuer and audience are in the registered claims; Expires is
+// when the user's password expires.  Editor and Roles tell the client what
+// to show, but the API checks the permissions of the roles on each request.
 type JwtClaims struct {
 	Id         string    `json:"id"`
 	Email      string    `json:"email"`
 	Editor     bool      `json:"editor"`
-	Exp        int64     `json:"exp"`
+	Roles      []string  `json:"roles"`
 	Expires    time.Time `json:"expires"`
 	MustChange bool      `json:"mustchange"`
 	Locked     bool      `json:"locked"`
 	Uuid       string    `json:"uuid"`
-	jwt.StandardClaims
+	TwoFactor  bool      `json:"twofactor"`
+	jwt.RegisteredClaims
 }
 
+// LoginResponse provides the tokens for a new session.  RecoveryKey is only
+// given when the user's journal key was just created, and Warnings tell the
+// user of anything they should act on, like a journal without a recovery
+// key.
 type LoginResponse struct {
-	Token string `json:"token"`
+	Token        string   `json:"token"`
+	RefreshToken string   `json:"refresh_token"`
+	RecoveryKey  string   `json:"recovery_key,omitempty"`
+	Warnings     []string `json:"warnings,omitempty"`
 }
@@ -1,13 +1,10 @@
 package models
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	rd "crypto/rand"
 	"errors"
-	"io"
-	"math/big"
-	"strconv"
+	"net/http"
+	"sort"
 	"strings"
 	"time"
 
@@ -16,176 +13,135 @@ import (
 
 type EntryReference struct {
 	ID        uint64 `json:"id" gorm:"primaryKey;column:id;autoIncrement"`
-	EntryID   string `json:"-" gorm:"column:entry_id"`
+	EntryID   string `json:"-" gorm:"column:entry_id;index"`
 	Book      string `json:"book" gorm:"column:book"`
 	Chapter   uint8  `json:"chapter" gorm:"column:chapter"`
 	VerseList string `json:"verses" gorm:"column:verses"`
 }
 
-type EntryText struct {
-	ID        uint64 `json:"id" gorm:"primaryKey;column:id;autoIncrement"`
-	EntryID   string `json:"-" gorm:"column:entry_id"`
-	TextType  string `json:"texttype" gorm:"column:text_type"`
-	Encrypted bool   `json:"encrypted" gorm:"column:encrypted"`
-	EntryText string `json:"entrytext" gorm:"column:entrytext"`
+func (EntryReference) TableName() string {
+	return "entry_references"
 }
 
-func (et *EntryText) EncryptText(privkey string, entrykey string) error {
-	if !et.Encrypted {
-		tempkey := []byte(entrykey)
-		c, err := aes.NewCipher([]byte(privkey))
-		if err != nil {
-			return err
-		}
-
-		gcm, err := cipher.NewGCM(c)
-		if err != nil {
-			return err
-		}
+// EntryText is one section of a journal entry.  The text is kept sealed
+// with the entry's key, stored as an Envelope, and can only be opened for
+// the same entry and section.  Position keeps the order the custom sections
+// were given in.
+type EntryText struct {
+	ID        uint64  `json:"id" gorm:"primaryKey;column:id;autoIncrement"`
+	EntryID   string  `json:"-" gorm:"column:entry_id;index"`
+	TextType  Section `json:"texttype" gorm:"column:text_type"`
+	Position  uint8   `json:"-" gorm:"column:position"`
+	Encrypted bool    `json:"encrypted" gorm:"column:encrypted"`
+	EntryText string  `json:"entrytext" gorm:"column:entrytext"`
+}
 
-		nonceSize := gcm.NonceSize()
-		if len(entrykey) < nonceSize {
-			return errors.New("entry key too small")
-		}
+func (EntryText) TableName() string {
+	return "entry_texts"
+}
 
-		nonce, cipherkey := tempkey[:nonceSize], tempkey[nonceSize:]
-		key, err := gcm.Open(nil, nonce, cipherkey, nil)
-		if err != nil {
-			return err
-		}
+// context function will provide the context the text is sealed with: the
+// entry's id and the section, so a sealed text can't be moved to another
+// entry or section.
+func (et *EntryText) context(e *Entry) []byte {
+	return []byte(e.ID + "/" + string(et.TextType))
+}
 
-		c, err = aes.NewCipher(key)
+// EncryptText function will seal the text with the entry's key, which is
+// itself sealed with the user's key.
+func (et *EntryText) EncryptText(userkey []byte, e *Entry) error {
+	if !et.Encrypted {
+		key, err := e.openKey(userkey)
 		if err != nil {
 			return err
 		}
-
-		gcm, err = cipher.NewGCM(c)
+		sealed, err := Seal(key, []byte(et.EntryText), et.context(e))
 		if err != nil {
 			return err
 		}
-
-		nonce = make([]byte, gcm.NonceSize())
-		if _, err = io.ReadFull(rd.Reader, nonce); err != nil {
-			return err
-		}
-
-		text := []byte(et.EntryText)
-
-		et.EntryText = string(gcm.Seal(nonce, nonce, text, nil))
+		et.EntryText = sealed
 		et.Encrypted = true
 	}
 	return nil
 }
 
-func (et *EntryText) DecryptText(privkey string, entrykey string) error {
+// DecryptText function will open the text with the entry's key.
+func (et *EntryText) DecryptText(userkey []byte, e *Entry) error {
 	if et.Encrypted {
-		tempkey := []byte(entrykey)
-		c, err := aes.NewCipher([]byte(privkey))
-		if err != nil {
-			return err
-		}
-
-		gcm, err := cipher.NewGCM(c)
-		if err != nil {
-			return err
-		}
-
-		nonceSize := gcm.NonceSize()
-		if len(entrykey) < nonceSize {
-			return errors.New("entry key too small")
-		}
-
-		nonce, cipherkey := tempkey[:nonceSize], tempkey[nonceSize:]
-		key, err := gcm.Open(nil, nonce, cipherkey, nil)
+		key, err := e.openKey(userkey)
 		if err != nil {
 			return err
 		}
-
-		c, err = aes.NewCipher(key)
-		if err != nil {
-			return err
-		}
-
-		gcm, err = cipher.NewGCM(c)
-		if err != nil {
-			return err
-		}
-
-		text := []byte(et.EntryText)
-		nonceSize = gcm.NonceSize()
-		if len(text) < nonceSize {
-			return errors.New("encrypted text too small")
-		}
-
-		plainText, err := gcm.Open(nil, nonce, text, nil)
+		text, err := Open(key, et.EntryText, et.context(e))
 		if err != nil {
 			return err
 		}
-		et.EntryText = string(plainText)
+		et.EntryText = string(text)
 		et.Encrypted = false
 	}
 	return nil
 }
 
+// Entry is a user's journal entry for a day.  The entry's key is random
+// and sealed with the user's key, and encrypts the entry's texts.  Entries
+// sealed with a journal key that was discarded are listed as unreadable.
 type Entry struct {
-	ID        string           `json:"id" gorm:"primaryKey;column:id"`
-	UserID    string           `json:"user" gorm:"column:user_id"`
-	Key       string           `json:"-" gorm:"column:privacy"`
-	EntryDate time.Time        `json:"entrydate" bson:"entrydate"`
-	Title     string           `json:"title" bson:"title"`
-	Reference []EntryReference `json:"reference" bson:"reference"`
-	Texts     []EntryText      `json:"texts" bson:"scripture"`
+	ID         string           `json:"id" gorm:"primaryKey;column:id"`
+	UserID     string           `json:"user" gorm:"column:user_id;index"`
+	Key        string           `json:"-" gorm:"column:privacy"`
+	EntryDate  time.Time        `json:"entrydate" gorm:"column:entrydate;index"`
+	Title      string           `json:"title" gorm:"column:title"`
+	Reference  []EntryReference `json:"reference" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	Texts      []EntryText      `json:"texts" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	Unreadable bool             `json:"unreadable,omitempty" gorm:"-"`
 }
 
-func (e *Entry) CreateEntryKey(userkey string) error {
-	c, err := aes.NewCipher([]byte(userkey))
-	if err != nil {
-		return err
-	}
+func (Entry) TableName() string {
+	return "entries"
+}
 
-	gcm, err := cipher.NewGCM(c)
-	if err != nil {
+// CreateEntryKey function will give the entry a new random key, sealed with
+// the user's key.
+func (e *Entry) CreateEntryKey(userkey []byte) error {
+	key := make([]byte, 32)
+	if _, err := rd.Read(key); err != nil {
 		return err
 	}
-
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err = io.ReadFull(rd.Reader, nonce); err != nil {
+	sealed, err := Seal(userkey, key, e.keyContext())
+	if err != nil {
 		return err
 	}
-
-	privKey := []byte(e.CreateRandomKey())
-	e.Key = string(gcm.Seal(nonce, nonce, privKey, nil))
+	e.Key = sealed
 	return nil
 }
 
-func (e *Entry) CreateRandomKey() string {
-	lower := "abcdefghijklmnopqrstuvwxyz"
-	randPasswd := ""
-	for len([]byte(randPasswd)) < 32 {
-		j, _ := rd.Int(rd.Reader, big.NewInt(3))
-		if j.Int64() == 0 {
-			lPos, _ := rd.Int(rd.Reader, big.NewInt(26))
-			randPasswd += lower[lPos.Int64() : lPos.Int64()+1]
-		} else if j.Int64() == 1 {
-			uPos, _ := rd.Int(rd.Reader, big.NewInt(26))
-			randPasswd += strings.ToUpper(lower[uPos.Int64() : uPos.Int64()+1])
-		} else {
-			num, _ := rd.Int(rd.Reader, big.NewInt(10))
-			randPasswd += strconv.FormatInt(num.Int64(), 10)
-		}
-	}
-	return randPasswd
+// openKey function will unseal the entry's key with the user's key.
+func (e *Entry) openKey(userkey []byte) ([]byte, error) {
+	return Open(userkey, e.Key, e.keyContext())
+}
+
+// keyContext function will provide the context the entry's key is sealed
+// with: the user's id and the entry's id, so the key only opens for its own
+// entry.
+func (e *Entry) keyContext() []byte {
+	return []byte(e.UserID + "/" + e.ID)
 }
 
-func (e *Entry) SetEntryText(field string, text string, userkey string) error {
-	var err error
+// SetEntryText function will set the text of the entry's section, adding
+// the section if the entry doesn't have it.  The text is encrypted with the
+// entry's key.
+func (e *Entry) SetEntryText(field string, text string, userkey []byte) error {
+	section, err := ParseSection(field)
+	if err != nil {
+		return err
+	}
 	found := false
 	for i, txt := range e.Texts {
-		if !found && strings.EqualFold(txt.TextType, field) {
+		if !found && txt.TextType == section {
 			found = true
 			txt.Encrypted = false
 			txt.EntryText = text
-			err = txt.EncryptText(userkey, e.Key)
+			err = txt.EncryptText(userkey, e)
 			e.Texts[i] = txt
 		}
 	}
@@ -193,9 +149,10 @@ func (e *Entry) SetEntryText(field string, text string, userkey string) error {
 		txt := EntryText{}
 		txt.Encrypted = false
 		txt.EntryText = text
-		txt.TextType = field
+		txt.TextType = section
+		txt.Position = uint8(len(e.Texts))
 		txt.EntryID = e.ID
-		err = txt.EncryptText(userkey, e.Key)
+		err = txt.EncryptText(userkey, e)
 		e.Texts = append(e.Texts, txt)
 	}
 	if err != nil {
@@ -204,7 +161,7 @@ func (e *Entry) SetEntryText(field string, text string, userkey string) error {
 	return nil
 }
 
-func NewEntry(user string, userKey string, entryDate time.Time) (*Entry, error) {
+func NewEntry(user string, userKey []byte, entryDate time.Time) (*Entry, error) {
 	answer := Entry{
 		ID:        uuid.NewString(),
 		UserID:    user,
@@ -216,3 +173,99 @@ func NewEntry(user string, userKey string, entryDate time.Time) (*Entry, error)
 	}
 	return &answer, nil
 }
+
+// DecryptTexts function will decrypt each of the entry's texts for the
+// entry's owner.
+func (e *Entry) DecryptTexts(userkey []byte) error {
+	for i := range e.Texts {
+		if err := e.Texts[i].DecryptText(userkey, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListTexts function will decrypt the entry's texts for a listing of the
+// owner's entries.  An entry sealed with a previous journal key, which a
+// password reset without the recovery key discards, is marked unreadable
+// and given without its texts, so the rest of the entries can still be
+// listed and the owner can remove it.
+func (e *Entry) ListTexts(userkey []byte) error {
+	err := e.DecryptTexts(userkey)
+	if errors.Is(err, ErrWrongKey) {
+		e.Unreadable = true
+		e.Texts = make([]EntryText, 0)
+		return nil
+	}
+	return err
+}
+
+// EntryRequest is the content of a journal entry sent to create or replace
+// an entry.  The date is given as YYYY-MM-DD.
+type EntryRequest struct {
+	EntryDate  string           `json:"entrydate" binding:"required"`
+	Title      string           `json:"title"`
+	References []EntryReference `json:"reference"`
+	Texts      []EntryText      `json:"texts"`
+}
+
+// Validate function will check the entry's date, title and texts, providing
+// the date.
+func (r *EntryRequest) Validate() (time.Time, *ErrorMessage) {
+	details := make([]string, 0)
+	date, err := time.Parse("2006-01-02", r.EntryDate)
+	if err != nil {
+		details = append(details, "Entry date must be given as YYYY-MM-DD")
+	}
+	r.Title = strings.TrimSpace(r.Title)
+	if len(r.Title) > 200 {
+		details = append(details, "Title must be at most 200 characters")
+	}
+	for _, ref := range r.References {
+		if strings.TrimSpace(ref.Book) == "" || ref.Chapter == 0 {
+			details = append(details, "References need a book and chapter")
+			break
+		}
+	}
+	details = append(details, checkSections(r.Texts)...)
+	if len(details) > 0 {
+		return date, &ErrorMessage{
+			ErrorType:  "entry",
+			StatusCode: http.StatusBadRequest,
+			Message:    "Invalid entry",
+			Details:    details,
+		}
+	}
+	return date, nil
+}
+
+// Apply function will replace the entry's date, title, references and
+// texts with the request's, encrypting the texts.
+func (r *EntryRequest) Apply(e *Entry, date time.Time, userkey []byte) error {
+	e.EntryDate = date
+	e.Title = r.Title
+	e.Reference = make([]EntryReference, 0)
+	for _, ref := range r.References {
+		e.Reference = append(e.Reference, EntryReference{
+			EntryID:   e.ID,
+			Book:      strings.TrimSpace(ref.Book),
+			Chapter:   ref.Chapter,
+			VerseList: strings.TrimSpace(ref.VerseList),
+		})
+	}
+	e.Texts = make([]EntryText, 0)
+	for _, txt := range r.Texts {
+		err := e.SetEntryText(string(txt.TextType), txt.EntryText, userkey)
+		if err != nil {
+			return err
+		}
+	}
+	e.SortTexts()
+	return nil
+}
+
+// SortTexts function will put the entry's texts in the order they are
+// shown.
+func (e *Entry) SortTexts() {
+	sort.Stable(ByEntryText(e.Texts))
+}
@@ -0,0 +1,187 @@
+package models
+
+import (
+	rd "crypto/rand"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func newUserKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rd.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// storeEntry function will provide the entry as it is loaded again after
+// being stored, with only the stored fields.
+func storeEntry(e *Entry) *Entry {
+	stored := &Entry{ID: e.ID, UserID: e.UserID, Key: e.Key,
+		EntryDate: e.EntryDate, Title: e.Title}
+	for _, txt := range e.Texts {
+		stored.Texts = append(stored.Texts, EntryText{
+			EntryID:   txt.EntryID,
+			TextType:  txt.TextType,
+			Position:  txt.Position,
+			Encrypted: txt.Encrypted,
+			EntryText: txt.EntryText,
+		})
+	}
+	return stored
+}
+
+func TestEntryTextsRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		texts []EntryText
+	}{
+		{name: "soap sections", texts: []EntryText{
+			{TextType: "S", EntryText: "John 3:16"},
+			{TextType: "observation", EntryText: "God so loved the world"},
+			{TextType: "Application", EntryText: "Love others"},
+			{TextType: "p", EntryText: "Thank you"},
+		}},
+		{name: "custom sections", texts: []EntryText{
+			{TextType: "Questions", EntryText: "Who is my neighbor?"},
+			{TextType: "scripture", EntryText: "Luke 10:29"},
+			{TextType: "Memory Verse", EntryText: "Luke 10:27"},
+		}},
+		{name: "empty text", texts: []EntryText{
+			{TextType: "prayer", EntryText: ""},
+		}},
+		{name: "unicode", texts: []EntryText{
+			{TextType: "observation", EntryText: "ἐν ἀρχῇ ἦν ὁ λόγος"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userkey := newUserKey(t)
+			entry, err := NewEntry("user-1", userkey, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := &EntryRequest{EntryDate: "2021-10-01", Texts: tt.texts}
+			date, errMsg := req.Validate()
+			if errMsg != nil {
+				t.Fatal(errMsg.Details)
+			}
+			if err = req.Apply(entry, date, userkey); err != nil {
+				t.Fatal(err)
+			}
+			want := make(map[Section]string)
+			for _, txt := range req.Texts {
+				want[txt.TextType] = txt.EntryText
+			}
+			for _, txt := range entry.Texts {
+				if !txt.Encrypted || (want[txt.TextType] != "" &&
+					txt.EntryText == want[txt.TextType]) {
+					t.Errorf("section %s not encrypted", txt.TextType)
+				}
+			}
+
+			loaded := storeEntry(entry)
+			if err = loaded.DecryptTexts(userkey); err != nil {
+				t.Fatal(err)
+			}
+			if len(loaded.Texts) != len(want) {
+				t.Fatalf("got %d texts, want %d", len(loaded.Texts), len(want))
+			}
+			for _, txt := range loaded.Texts {
+				if txt.Encrypted || txt.EntryText != want[txt.TextType] {
+					t.Errorf("section %s is %q, want %q", txt.TextType,
+						txt.EntryText, want[txt.TextType])
+				}
+			}
+		})
+	}
+}
+
+func TestEntryTextsBoundToEntry(t *testing.T) {
+	userkey := newUserKey(t)
+	newEntry := func(userID string) *Entry {
+		entry, err := NewEntry(userID, userkey, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, section := range SOAPSections {
+			err = entry.SetEntryText(string(section), "text of "+
+				string(section), userkey)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return storeEntry(entry)
+	}
+	tests := []struct {
+		name   string
+		change func(e *Entry, other *Entry)
+		key    []byte
+	}{
+		{name: "sections swapped", change: func(e *Entry, other *Entry) {
+			e.Texts[0].EntryText, e.Texts[1].EntryText =
+				e.Texts[1].EntryText, e.Texts[0].EntryText
+		}},
+		{name: "text from another entry", change: func(e *Entry, other *Entry) {
+			e.Texts[0].EntryText = other.Texts[0].EntryText
+		}},
+		{name: "key from another entry", change: func(e *Entry, other *Entry) {
+			e.Key = other.Key
+		}},
+		{name: "entry given to another user", change: func(e *Entry,
+			other *Entry) {
+			e.UserID = other.UserID
+		}},
+		{name: "another user's key", key: newUserKey(t)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry, other := newEntry("user-1"), newEntry("user-2")
+			if tt.change != nil {
+				tt.change(entry, other)
+			}
+			key := userkey
+			if tt.key != nil {
+				key = tt.key
+			}
+			if err := entry.DecryptTexts(key); err == nil {
+				t.Error("texts opened")
+			}
+		})
+	}
+}
+
+func TestEntryRequiresEnvelope(t *testing.T) {
+	userkey := newUserKey(t)
+	entry, err := NewEntry("user-1", userkey, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = entry.SetEntryText("observation", "He restores my soul", userkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a text without its header, only the nonce and the sealed text, isn't
+	// read.
+	stripped := storeEntry(entry)
+	env, err := ParseEnvelope(stripped.Texts[0].EntryText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped.Texts[0].EntryText = base64.StdEncoding.EncodeToString(
+		append(env.Nonce, env.Sealed...))
+	if err = stripped.DecryptTexts(userkey); err == nil {
+		t.Error("text opened without its header")
+	}
+
+	// nor is a text with a changed header.
+	changed := storeEntry(entry)
+	env.Nonce[0] ^= 1
+	changed.Texts[0].EntryText = env.String()
+	if err = changed.DecryptTexts(userkey); err == nil {
+		t.Error("text opened with a changed header")
+	}
+}
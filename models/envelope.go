@@ -0,0 +1,165 @@
+package models
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	rd "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// Envelope is a sealed value as it is stored: base64 encoded, a header
+// giving the format version, the algorithm, the id of the key that sealed
+// it and the nonce, then the sealed value.
+//
+//	"SOAP" | version | algorithm | key id length | key id |
+//	nonce length | nonce | sealed value
+//
+// The header is authenticated with the value, so it can't be changed.
+type Envelope struct {
+	Version   byte
+	Algorithm byte
+	KeyID     []byte
+	Nonce     []byte
+	Sealed    []byte
+}
+
+const (
+	envelopeMagic = "SOAP"
+
+	EnvelopeVersion byte = 1
+	AlgAES256GCM    byte = 1
+)
+
+// ErrWrongKey is given when a value is opened with a key other than the one
+// that sealed it.
+var ErrWrongKey = errors.New("sealed with a different key")
+
+// KeyID function will provide the id of a key, which tells which key sealed
+// a value without showing anything of the key.
+func KeyID(key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return sum[:8]
+}
+
+// Seal function will encrypt the value with the 32 byte key, providing the
+// envelope as it is stored.  The context, like the id of the value's owner,
+// must be given again to open the value.
+func Seal(key []byte, value []byte, context []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	env := &Envelope{
+		Version:   EnvelopeVersion,
+		Algorithm: AlgAES256GCM,
+		KeyID:     KeyID(key),
+		Nonce:     make([]byte, gcm.NonceSize()),
+	}
+	if _, err = rd.Read(env.Nonce); err != nil {
+		return "", err
+	}
+	env.Sealed = gcm.Seal(nil, env.Nonce, value, env.additionalData(context))
+	return env.String(), nil
+}
+
+// Open function will decrypt the stored value with the key.
+func Open(key []byte, text string, context []byte) ([]byte, error) {
+	env, err := ParseEnvelope(text)
+	if err != nil {
+		return nil, err
+	}
+	return env.Open(key, context)
+}
+
+// ParseEnvelope function will read the header of a stored value.
+func ParseEnvelope(text string) (*Envelope, error) {
+	data, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte(envelopeMagic)) {
+		return nil, errors.New("unknown sealed value format")
+	}
+	data = data[len(envelopeMagic):]
+	env := &Envelope{}
+	next := func() ([]byte, bool) {
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return nil, false
+		}
+		field := data[1 : 1+int(data[0])]
+		data = data[1+int(data[0]):]
+		return field, true
+	}
+	ok := len(data) >= 2
+	if ok {
+		env.Version, env.Algorithm = data[0], data[1]
+		data = data[2:]
+		env.KeyID, ok = next()
+	}
+	if ok {
+		env.Nonce, ok = next()
+	}
+	if !ok {
+		return nil, errors.New("sealed value header too small")
+	}
+	env.Sealed = data
+	if env.Version != EnvelopeVersion {
+		return nil, fmt.Errorf("unknown sealed value version %d", env.Version)
+	}
+	return env, nil
+}
+
+// Open function will decrypt the envelope's value with the key, checking
+// that it is the key the value was sealed with.
+func (env *Envelope) Open(key []byte, context []byte) ([]byte, error) {
+	if env.Algorithm != AlgAES256GCM {
+		return nil, fmt.Errorf("unknown sealed value algorithm %d",
+			env.Algorithm)
+	}
+	if !bytes.Equal(env.KeyID, KeyID(key)) {
+		return nil, ErrWrongKey
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(env.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid sealed value nonce")
+	}
+	return gcm.Open(nil, env.Nonce, env.Sealed, env.additionalData(context))
+}
+
+// String function will provide the envelope as it is stored.
+func (env *Envelope) String() string {
+	return base64.StdEncoding.EncodeToString(
+		append(env.header(), env.Sealed...))
+}
+
+func (env *Envelope) header() []byte {
+	header := []byte(envelopeMagic)
+	header = append(header, env.Version, env.Algorithm, byte(len(env.KeyID)))
+	header = append(header, env.KeyID...)
+	header = append(header, byte(len(env.Nonce)))
+	return append(header, env.Nonce...)
+}
+
+// additionalData function will provide the data authenticated with the
+// value: the header and the context.
+func (env *Envelope) additionalData(context []byte) []byte {
+	return append(env.header(), context...)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("keys must be 32 bytes, not %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,273 @@
+package models
+
+import (
+	rd "crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2Params provides the Argon2id cost used to derive the key that wraps
+// a user's journal key from their password.  Memory is given in KiB.
+type Argon2Params struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// KeyDerivation provides the cost used when a journal key is wrapped.  Keys
+// wrapped before a change keep the cost they were wrapped with until the
+// next password change.
+var KeyDerivation = Argon2Params{Time: 3, Memory: 64 * 1024, Threads: 2}
+
+// String function will provide the parameters as they are stored with the
+// wrapped key.
+func (p Argon2Params) String() string {
+	return fmt.Sprintf("argon2id$m=%d,t=%d,p=%d", p.Memory, p.Time, p.Threads)
+}
+
+func parseArgon2Params(text string) (Argon2Params, error) {
+	var p Argon2Params
+	_, err := fmt.Sscanf(text, "argon2id$m=%d,t=%d,p=%d", &p.Memory, &p.Time,
+		&p.Threads)
+	if err != nil || p.Time == 0 || p.Memory == 0 || p.Threads == 0 {
+		return p, fmt.Errorf("unknown key derivation %s", text)
+	}
+	return p, nil
+}
+
+// derive function will provide the key encryption key for the password.
+func (p Argon2Params) derive(passwd string, salt []byte) []byte {
+	return argon2.IDKey([]byte(passwd), salt, p.Time, p.Memory, p.Threads, 32)
+}
+
+// HasJournalKey function will report if the user's journal key has been
+// created, wrapped with their password or only with a recovery key.
+func (c *Credentials) HasJournalKey() bool {
+	return c.JournalKey != "" || c.JournalRecovery != ""
+}
+
+// EnrollJournalKey function will create the user's journal key and wrap it
+// with the password and with a new recovery key, providing the journal key
+// and the recovery key to show the user.  A key the user's entries were
+// already sealed with is kept as the journal key, so the entries can still
+// be read.  Without a password, as for users created by the identity
+// provider, the key is only wrapped with the recovery key until a password
+// is set with the forgot password process.
+func (c *Credentials) EnrollJournalKey(passwd string) ([]byte, string,
+	error) {
+	master := []byte(c.PrivateKey)
+	if len(master) == 0 {
+		master = make([]byte, 32)
+		if _, err := rd.Read(master); err != nil {
+			return nil, "", err
+		}
+	}
+	if passwd != "" {
+		if err := c.RewrapJournalKey(master, passwd); err != nil {
+			return nil, "", err
+		}
+	} else {
+		c.JournalKeyID = JournalKeyID(master)
+	}
+	recovery, err := c.NewRecoveryKey(master)
+	if err != nil {
+		return nil, "", err
+	}
+	c.PrivateKey = ""
+	return master, recovery, nil
+}
+
+// ResetJournalKey function will replace the user's journal key and recovery
+// key with new keys, as when the password was forgotten and the journal key
+// can't be unwrapped.
+func (c *Credentials) ResetJournalKey(passwd string) ([]byte, string,
+	error) {
+	c.JournalKey = ""
+	c.JournalRecovery = ""
+	return c.EnrollJournalKey(passwd)
+}
+
+// UnlockJournalKey function will unwrap the user's journal key with the
+// password.
+func (c *Credentials) UnlockJournalKey(passwd string) ([]byte, error) {
+	if c.JournalKey == "" {
+		return nil, errors.New("no journal key wrapped with the password")
+	}
+	params, err := parseArgon2Params(c.JournalKDF)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := base64.StdEncoding.DecodeString(c.JournalSalt)
+	if err != nil {
+		return nil, err
+	}
+	return Open(params.derive(passwd, salt), c.JournalKey, []byte(c.UserID))
+}
+
+// RewrapJournalKey function will wrap the journal key with a new password,
+// as when the password is changed.  Only the wrapped key is replaced, so the
+// entries sealed with the journal key aren't encrypted again.
+func (c *Credentials) RewrapJournalKey(master []byte, passwd string) error {
+	salt := make([]byte, 16)
+	if _, err := rd.Read(salt); err != nil {
+		return err
+	}
+	wrapped, err := Seal(KeyDerivation.derive(passwd, salt), master,
+		[]byte(c.UserID))
+	if err != nil {
+		return err
+	}
+	c.JournalKey = wrapped
+	c.JournalSalt = base64.StdEncoding.EncodeToString(salt)
+	c.JournalKDF = KeyDerivation.String()
+	c.JournalKeyID = JournalKeyID(master)
+	return nil
+}
+
+// JournalKeyID function will provide the id of a journal key, as kept with
+// the credentials.
+func JournalKeyID(master []byte) string {
+	return hex.EncodeToString(KeyID(master))
+}
+
+// HasRecoveryKey function will report if the user's journal key is also
+// wrapped with a recovery key.
+func (c *Credentials) HasRecoveryKey() bool {
+	return c.JournalRecovery != ""
+}
+
+// NewRecoveryKey function will wrap the journal key with a new random
+// recovery key, replacing any earlier recovery key, and provide the recovery
+// key in groups of four characters for the user to print or write down.
+func (c *Credentials) NewRecoveryKey(master []byte) (string, error) {
+	raw := make([]byte, 20)
+	if _, err := rd.Read(raw); err != nil {
+		return "", err
+	}
+	wrapped, err := Seal(recoveryKEK(raw), master, []byte(c.UserID))
+	if err != nil {
+		return "", err
+	}
+	c.JournalRecovery = wrapped
+	encoded := base32.StdEncoding.EncodeToString(raw)
+	groups := make([]string, 0)
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+// RecoverJournalKey function will unwrap the user's journal key with the
+// recovery key.  The key may be given without its dashes and in any case.
+func (c *Credentials) RecoverJournalKey(recovery string) ([]byte, error) {
+	if !c.HasRecoveryKey() {
+		return nil, errors.New("no recovery key")
+	}
+	recovery = strings.Map(func(r rune) rune {
+		switch {
+		case r == '-' || unicode.IsSpace(r):
+			return -1
+		case r == '0':
+			return 'O'
+		case r == '1':
+			return 'I'
+		}
+		return unicode.ToUpper(r)
+	}, recovery)
+	raw, err := base32.StdEncoding.DecodeString(recovery)
+	if err != nil || len(raw) != 20 {
+		return nil, errors.New("invalid recovery key")
+	}
+	return Open(recoveryKEK(raw), c.JournalRecovery, []byte(c.UserID))
+}
+
+// RecoverJournalAttempt function will unwrap the journal key with the
+// recovery key the signed in user gave, like RecoverJournalKey.  A wrong
+// recovery key counts as a bad attempt, as at log in, so enough of them lock
+// the account.
+func (c *Credentials) RecoverJournalAttempt(recovery string) ([]byte,
+	*ErrorMessage) {
+	if c.IsLocked() {
+		return nil, c.lockedError()
+	}
+	master, err := c.RecoverJournalKey(recovery)
+	if err == nil {
+		c.BadAttempts = 0
+		return master, nil
+	}
+	if c.recordFailure() {
+		return nil, c.lockedError()
+	}
+	return nil, &ErrorMessage{
+		ErrorType:  "journal",
+		StatusCode: http.StatusUnauthorized,
+		Message:    "Recovery key is incorrect",
+		Details:    []string{err.Error()},
+	}
+}
+
+// recoveryKEK function will provide the key encryption key for a recovery
+// key.  The recovery key is random, so it needs no slow derivation like a
+// password.
+func recoveryKEK(raw []byte) []byte {
+	sum := sha256.Sum256(append([]byte("go-soap journal recovery "), raw...))
+	return sum[:]
+}
+
+// ResetJournal function will decide what becomes of the user's journal key
+// when a forgotten password is reset, after the reset token was checked.
+// The key is unwrapped with the recovery key to be wrapped with the new
+// password.  Without a recovery key the entries can't be read after the
+// reset, so the reset only goes on when the user chose to discard the
+// journal, and no journal key is given.  A bad recovery key counts as a
+// failed reset.
+func (c *Credentials) ResetJournal(recovery string,
+	discard bool) ([]byte, *ErrorMessage) {
+	if !c.HasJournalKey() || (recovery == "" && discard) {
+		return nil, nil
+	}
+	if recovery != "" {
+		master, err := c.RecoverJournalKey(recovery)
+		if err != nil {
+			return nil, c.resetFailure("Invalid recovery key")
+		}
+		return master, nil
+	}
+	details := []string{"Without your recovery key a new journal is started " +
+		"and your entries can't be read again"}
+	if c.HasRecoveryKey() {
+		details = append(details,
+			"Give your recovery key to keep your entries readable")
+	} else {
+		details = append(details, "Your journal has no recovery key")
+	}
+	return nil, &ErrorMessage{
+		ErrorType:  "journal",
+		StatusCode: http.StatusConflict,
+		Message:    "Resetting the password discards your journal entries",
+		Details: append(details,
+			"Send discard_journal to reset the password anyway"),
+	}
+}
+
+// JournalLocked provides the error sent when a request needs the user's
+// journal key and it isn't unlocked for the session.
+func JournalLocked() *ErrorMessage {
+	return &ErrorMessage{
+		ErrorType:  "journal",
+		StatusCode: http.StatusLocked,
+		Message:    "Journal locked",
+		Details: []string{
+			"Unlock the journal with your password to read or write entries",
+		},
+	}
+}
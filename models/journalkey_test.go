@@ -0,0 +1,117 @@
+package models
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestPasswordlessJournalKey(t *testing.T) {
+	params := KeyDerivation
+	defer func() { KeyDerivation = params }()
+	KeyDerivation = Argon2Params{Time: 1, Memory: 64, Threads: 1}
+
+	creds := &Credentials{UserID: "user-1"}
+	master, recovery, err := creds.EnrollJournalKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !creds.HasJournalKey() || creds.JournalKey != "" ||
+		creds.JournalKeyID != JournalKeyID(master) {
+		t.Fatalf("journal key not wrapped with only the recovery key: %+v",
+			creds)
+	}
+	if _, err = creds.UnlockJournalKey(""); err == nil {
+		t.Error("journal unlocked without a password")
+	}
+	key, err := creds.RecoverJournalKey(recovery)
+	if err != nil || !bytes.Equal(key, master) {
+		t.Fatalf("recovery key didn't unlock the journal: %v", err)
+	}
+
+	// setting a password with the forgot password process keeps the key.
+	if _, errMsg := creds.ResetJournal("", false); errMsg == nil {
+		t.Error("journal discarded without the recovery key")
+	}
+	key, errMsg := creds.ResetJournal(recovery, false)
+	if errMsg != nil {
+		t.Fatal(errMsg.String())
+	}
+	if err = creds.RewrapJournalKey(key, "New Password 1"); err != nil {
+		t.Fatal(err)
+	}
+	key, err = creds.UnlockJournalKey("New Password 1")
+	if err != nil || !bytes.Equal(key, master) {
+		t.Fatalf("password didn't unlock the journal: %v", err)
+	}
+}
+
+func TestWrongRecoveryKeysLock(t *testing.T) {
+	params := KeyDerivation
+	defer func() { KeyDerivation = params }()
+	KeyDerivation = Argon2Params{Time: 1, Memory: 64, Threads: 1}
+
+	creds := &Credentials{UserID: "user-1"}
+	_, recovery, err := creds.EnrollJournalKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int16(0); i < Lockout.Threshold; i++ {
+		if _, errMsg := creds.RecoverJournalAttempt("AAAA-BBBB"); errMsg == nil {
+			t.Fatalf("attempt %d: wrong recovery key accepted", i+1)
+		}
+	}
+	if !creds.IsLocked() {
+		t.Fatalf("account not locked after %d wrong recovery keys",
+			Lockout.Threshold)
+	}
+	if _, errMsg := creds.RecoverJournalAttempt(recovery); errMsg == nil {
+		t.Error("journal unlocked while the account is locked")
+	}
+}
+
+func TestDiscardedJournalEntriesListed(t *testing.T) {
+	params := KeyDerivation
+	defer func() { KeyDerivation = params }()
+	KeyDerivation = Argon2Params{Time: 1, Memory: 64, Threads: 1}
+
+	creds := &Credentials{UserID: "user-1"}
+	master, _, err := creds.EnrollJournalKey("Password 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newEntry := func(key []byte, text string) *Entry {
+		entry, err := NewEntry(creds.UserID, key, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = entry.SetEntryText("observation", text, key); err != nil {
+			t.Fatal(err)
+		}
+		return storeEntry(entry)
+	}
+	old := newEntry(master, "Be still")
+
+	// the password is reset without the recovery key, discarding the journal.
+	if _, errMsg := creds.ResetJournal("", true); errMsg != nil {
+		t.Fatal(errMsg.String())
+	}
+	key, _, err := creds.ResetJournalKey("New Password 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := newEntry(key, "and know")
+
+	if err = old.ListTexts(key); err != nil {
+		t.Fatalf("old entry stopped the listing: %v", err)
+	}
+	if !old.Unreadable || len(old.Texts) != 0 {
+		t.Errorf("old entry not listed as unreadable: %+v", old)
+	}
+	if err = current.ListTexts(key); err != nil {
+		t.Fatal(err)
+	}
+	if current.Unreadable || current.Texts[0].EntryText != "and know" {
+		t.Errorf("new entry not readable: %+v", current)
+	}
+}
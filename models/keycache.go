@@ -0,0 +1,98 @@
+package models
+
+import (
+	"sync"
+	"time"
+)
+
+// SessionKeyLife provides how long an unlocked journal key is kept without
+// being used.  Each use keeps it for this long again.
+var SessionKeyLife = time.Minute * 30
+
+// SessionKeys holds the journal keys unlocked for the signed in sessions.
+var SessionKeys = NewKeyCache()
+
+// KeyCache holds unwrapped journal keys in memory by session, the refresh
+// family of the session's tokens, so the keys are never stored.  A server
+// restart locks every journal again.
+type KeyCache struct {
+	mu   sync.Mutex
+	keys map[string]*sessionKey
+}
+
+type sessionKey struct {
+	userID  string
+	key     []byte
+	expires time.Time
+}
+
+func NewKeyCache() *KeyCache {
+	return &KeyCache{keys: make(map[string]*sessionKey)}
+}
+
+// Put function will keep the user's journal key for the session, removing
+// the keys that have expired.
+func (kc *KeyCache) Put(session string, userID string, key []byte) {
+	if session == "" {
+		return
+	}
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	now := time.Now()
+	for id, sk := range kc.keys {
+		if sk.expires.Before(now) {
+			kc.remove(id)
+		}
+	}
+	kc.remove(session)
+	kc.keys[session] = &sessionKey{
+		userID:  userID,
+		key:     append([]byte(nil), key...),
+		expires: now.Add(SessionKeyLife),
+	}
+}
+
+// Get function will provide the user's journal key for the session, or false
+// if the journal isn't unlocked.
+func (kc *KeyCache) Get(session string, userID string) ([]byte, bool) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	sk, ok := kc.keys[session]
+	if !ok || sk.userID != userID {
+		return nil, false
+	}
+	if sk.expires.Before(time.Now()) {
+		kc.remove(session)
+		return nil, false
+	}
+	sk.expires = time.Now().Add(SessionKeyLife)
+	return append([]byte(nil), sk.key...), true
+}
+
+// Remove function will lock the journal for the session.
+func (kc *KeyCache) Remove(session string) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	kc.remove(session)
+}
+
+// RemoveUser function will lock the user's journal for all their sessions.
+func (kc *KeyCache) RemoveUser(userID string) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	for id, sk := range kc.keys {
+		if sk.userID == userID {
+			kc.remove(id)
+		}
+	}
+}
+
+// remove function will clear the key's bytes before forgetting it.
+func (kc *KeyCache) remove(session string) {
+	if sk, ok := kc.keys[session]; ok {
+		for i := range sk.key {
+			sk.key[i] = 0
+		}
+		delete(kc.keys, session)
+	}
+}
@@ -0,0 +1,309 @@
+package models
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Keys provides the keys used to sign and check the access tokens.
+var Keys = NewKeyManager()
+
+// SigningKey is a key for the access tokens.  The key's identifier is given
+// in each token's kid header, so the token can be checked with the right key
+// after the signing key has been replaced.  A key loaded from a public key
+// can only check tokens.
+type SigningKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// NewHMACKey function will create an HS384 key from the shared secret.
+func NewHMACKey(secret []byte) *SigningKey {
+	sum := sha256.Sum256(secret)
+	return &SigningKey{
+		ID:        "hs-" + base64.RawURLEncoding.EncodeToString(sum[:9]),
+		Method:    jwt.SigningMethodHS384,
+		signKey:   secret,
+		verifyKey: secret,
+	}
+}
+
+// NewAsymmetricKey function will create an RS256 or EdDSA key from the RSA or
+// Ed25519 key, which may be a private key or only a public key.  The key's
+// identifier is taken from the public key, so it stays the same each time
+// the key is loaded.
+func NewAsymmetricKey(key interface{}) (*SigningKey, error) {
+	k := new(SigningKey)
+	switch typed := key.(type) {
+	case *rsa.PrivateKey:
+		k.Method = jwt.SigningMethodRS256
+		k.signKey = typed
+		k.verifyKey = &typed.PublicKey
+	case *rsa.PublicKey:
+		k.Method = jwt.SigningMethodRS256
+		k.verifyKey = typed
+	case ed25519.PrivateKey:
+		k.Method = jwt.SigningMethodEdDSA
+		k.signKey = typed
+		k.verifyKey = typed.Public()
+	case ed25519.PublicKey:
+		k.Method = jwt.SigningMethodEdDSA
+		k.verifyKey = typed
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	if pub, ok := k.verifyKey.(*rsa.PublicKey); ok && pub.N.BitLen() < 2048 {
+		return nil, errors.New("rsa keys must be at least 2048 bits")
+	}
+	der, err := x509.MarshalPKIXPublicKey(k.verifyKey)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	prefix := "rs-"
+	if k.Method == jwt.SigningMethodEdDSA {
+		prefix = "ed-"
+	}
+	k.ID = prefix + base64.RawURLEncoding.EncodeToString(sum[:9])
+	return k, nil
+}
+
+// LoadKeyFile function will load an RSA or Ed25519 key from the PEM file,
+// which holds a PKCS #8 or PKCS #1 private key or a PKIX public key.
+func LoadKeyFile(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	var key interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unsupported PEM block %s", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return NewAsymmetricKey(key)
+}
+
+// CanSign function will report if the key has its private part, so it can
+// sign tokens.
+func (k *SigningKey) CanSign() bool {
+	return k.signKey != nil
+}
+
+// JSONWebKey is a public key in the JSON Web Key format of RFC 7517.
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// PublicKey function will provide the public key the JSON web key holds, for
+// checking tokens signed by other services.  RSA, P-256 and P-384 EC and
+// Ed25519 keys are supported.
+func (k *JSONWebKey) PublicKey() (interface{}, error) {
+	decode := func(value string) *big.Int {
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(data) == 0 {
+			return nil
+		}
+		return new(big.Int).SetBytes(data)
+	}
+	switch k.Kty {
+	case "RSA":
+		n, e := decode(k.N), decode(k.E)
+		if n == nil || e == nil || !e.IsInt64() || n.BitLen() < 2048 {
+			return nil, fmt.Errorf("invalid rsa key %s", k.Kid)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, y := decode(k.X), decode(k.Y)
+		if x == nil || y == nil || !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("invalid ec key %s", k.Kid)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		data, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(data) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid okp key %s", k.Kid)
+		}
+		return ed25519.PublicKey(data), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// JSONWebKeySet is the set of public keys other services use to check the
+// access tokens.
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JWK function will provide the public part of the key, or false for an
+// HMAC key, which must never be published.
+func (k *SigningKey) JWK() (JSONWebKey, bool) {
+	jwk := JSONWebKey{
+		Kid: k.ID,
+		Use: "sig",
+		Alg: k.Method.Alg(),
+	}
+	switch pub := k.verifyKey.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(
+			big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	default:
+		return jwk, false
+	}
+	return jwk, true
+}
+
+// KeyManager holds the key used to sign new access tokens and the keys still
+// accepted when checking them.  When the signing key is replaced, the old
+// key is kept so the tokens it signed stay valid until they expire.
+type KeyManager struct {
+	mu      sync.RWMutex
+	current *SigningKey
+	keys    map[string]*SigningKey
+}
+
+func NewKeyManager() *KeyManager {
+	return &KeyManager{
+		keys: make(map[string]*SigningKey),
+	}
+}
+
+// SetSigningKey function will make the key the one used to sign new tokens,
+// keeping the previous signing key for checking tokens.
+func (m *KeyManager) SetSigningKey(key *SigningKey) error {
+	if !key.CanSign() {
+		return fmt.Errorf("key %s has no private key", key.ID)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.current = key
+	m.keys[key.ID] = key
+	return nil
+}
+
+// AddVerificationKey function will add a key that is only used to check
+// tokens, like the key used before a rotation.
+func (m *KeyManager) AddVerificationKey(key *SigningKey) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[key.ID] = key
+}
+
+// RemoveKey function will stop accepting tokens signed with the key.  The
+// current signing key can't be removed.
+func (m *KeyManager) RemoveKey(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.current != nil && m.current.ID == id {
+		return errors.New("can't remove the signing key")
+	}
+	delete(m.keys, id)
+	return nil
+}
+
+// Sign function will sign the claims with the current signing key, giving
+// the key's identifier in the kid header.
+func (m *KeyManager) Sign(claims jwt.Claims) (string, error) {
+	m.mu.RLock()
+	key := m.current
+	m.mu.RUnlock()
+	if key == nil {
+		return "", errors.New("no signing key")
+	}
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.signKey)
+}
+
+// Parse function will check the token's signature with the key named in its
+// kid header, parsing its claims into the claims given.  The token's
+// algorithm must be the key's algorithm, so a public key can't be used as an
+// HMAC secret.  Tokens from before key identifiers were added are checked
+// with the current key.
+func (m *KeyManager) Parse(encoded string, claims jwt.Claims) (*jwt.Token,
+	error) {
+	return jwt.ParseWithClaims(encoded, claims,
+		func(token *jwt.Token) (interface{}, error) {
+			m.mu.RLock()
+			defer m.mu.RUnlock()
+			key := m.current
+			if kid, ok := token.Header["kid"].(string); ok {
+				key = m.keys[kid]
+			}
+			if key == nil {
+				return nil, fmt.Errorf("unknown key %v", token.Header["kid"])
+			}
+			if token.Method.Alg() != key.Method.Alg() {
+				return nil, fmt.Errorf("invalid token - %s", token.Header["alg"])
+			}
+			return key.verifyKey, nil
+		})
+}
+
+// JWKS function will provide the public keys accepted for the tokens, for
+// other services to check the tokens with.
+func (m *KeyManager) JWKS() JSONWebKeySet {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	set := JSONWebKeySet{Keys: make([]JSONWebKey, 0)}
+	for _, key := range m.keys {
+		if jwk, ok := key.JWK(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	sort.Slice(set.Keys, func(i, j int) bool {
+		return set.Keys[i].Kid < set.Keys[j].Kid
+	})
+	return set
+}
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"time"
+)
+
+// LockoutPolicy provides how many bad attempts in a row will lock an account
+// and for how long.  Each lock in a row doubles the lock period, up to
+// MaxDuration, and a successful log in starts the count again.
+type LockoutPolicy struct {
+	Threshold   int16
+	Duration    time.Duration
+	MaxDuration time.Duration
+}
+
+// Lockout provides the lockout policy used by Credentials.LogIn.
+var Lockout = LockoutPolicy{
+	Threshold:   3,
+	Duration:    time.Minute * 15,
+	MaxDuration: time.Hour * 24,
+}
+
+// period function will provide how long the account is locked for the
+// count'th lock in a row.
+func (p *LockoutPolicy) period(count int16) time.Duration {
+	period := p.Duration
+	for i := int16(1); i < count && period < p.MaxDuration; i++ {
+		period *= 2
+	}
+	if period > p.MaxDuration {
+		period = p.MaxDuration
+	}
+	return period
+}
+
+// recordFailure function will count a bad attempt, locking the account when
+// the policy's threshold is reached.  It reports if the account was locked.
+func (c *Credentials) recordFailure() bool {
+	c.BadAttempts++
+	if c.BadAttempts < Lockout.Threshold {
+		return false
+	}
+	c.BadAttempts = 0
+	c.LockCount++
+	c.Locked = true
+	c.LockedUntil = time.Now().Add(Lockout.period(c.LockCount))
+	return true
+}
+
+// IsLocked function will report if the account is locked, unlocking it when
+// the lock period has passed.  An account locked without an end time stays
+// locked until it is unlocked.
+func (c *Credentials) IsLocked() bool {
+	if !c.Locked {
+		return false
+	}
+	if !c.LockedUntil.IsZero() && c.LockedUntil.Before(time.Now()) {
+		c.Locked = false
+		c.BadAttempts = 0
+		c.LockedUntil = time.Time{}
+		return false
+	}
+	return true
+}
+
+// Disable function will lock the account without an end, so the user can't
+// log in until an editor unlocks the account.
+func (c *Credentials) Disable() {
+	c.Locked = true
+	c.LockedUntil = time.Time{}
+	c.BadAttempts = 0
+}
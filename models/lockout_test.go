@@ -0,0 +1,69 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func newTOTPCredentials(t *testing.T) *Credentials {
+	t.Helper()
+	creds := &Credentials{
+		UserID:   "user-1",
+		Verified: time.Now(),
+		Remotes:  []UserRemote{{RemoteIP: "10.0.0.1"}},
+	}
+	if ok, errMsg := creds.setHash("Password 1"); !ok {
+		t.Fatal(errMsg.String())
+	}
+	if _, err := creds.StartTOTP(); err != nil {
+		t.Fatal(err)
+	}
+	creds.TOTPEnabled = true
+	return creds
+}
+
+func TestLoginWrongTOTPLocks(t *testing.T) {
+	creds := newTOTPCredentials(t)
+	for i := int16(0); i < Lockout.Threshold; i++ {
+		ok, errMsg := creds.LogIn("Password 1", "10.0.0.1")
+		if !ok || errMsg != nil {
+			t.Fatalf("attempt %d: password refused: %v", i+1, errMsg)
+		}
+		if ok, _, _ = creds.VerifySecondFactor("wrong"); ok {
+			t.Fatalf("attempt %d: wrong code accepted", i+1)
+		}
+	}
+	if !creds.IsLocked() || creds.LockCount != 1 {
+		t.Fatalf("account not locked after %d wrong codes: %+v",
+			Lockout.Threshold, creds)
+	}
+	if ok, _ := creds.LogIn("Password 1", "10.0.0.1"); ok {
+		t.Error("locked account logged in")
+	}
+}
+
+func TestLoginTOTPResetsCount(t *testing.T) {
+	creds := newTOTPCredentials(t)
+	if ok, _, _ := creds.VerifySecondFactor("wrong"); ok {
+		t.Fatal("wrong code accepted")
+	}
+	creds.LockCount = 1
+	if ok, errMsg := creds.LogIn("Password 1", "10.0.0.1"); !ok {
+		t.Fatal(errMsg.String())
+	}
+	if creds.BadAttempts != 1 || creds.LockCount != 1 {
+		t.Fatalf("count started again before the code: %d bad, %d locks",
+			creds.BadAttempts, creds.LockCount)
+	}
+	code, err := totpCode(creds.TOTPSecret, time.Now().Unix()/totpPeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, errMsg := creds.VerifySecondFactor(code); !ok {
+		t.Fatal(errMsg.String())
+	}
+	if creds.BadAttempts != 0 || creds.LockCount != 0 {
+		t.Errorf("count not started again: %d bad, %d locks",
+			creds.BadAttempts, creds.LockCount)
+	}
+}
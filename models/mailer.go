@@ -0,0 +1,223 @@
+package models
+
+import (
+	"bytes"
+	rd "crypto/rand"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// MailMessage is a single email to a user, with both a plain text and an HTML
+// body.
+type MailMessage struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Bytes function will provide the message in MIME format, ready to be sent
+// or saved as an .eml file.
+func (m *MailMessage) Bytes(from string) ([]byte, error) {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.contentType)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		w, err := parts.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err = qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err = qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 12)
+	if _, err := rd.Read(id); err != nil {
+		return nil, err
+	}
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = strings.Trim(from[at+1:], "> ")
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", m.To)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n",
+		parts.Boundary())
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// Mailer sends email messages.
+type Mailer interface {
+	Send(msg *MailMessage) error
+}
+
+// SMTPMailer sends the messages through an SMTP server.  The user name and
+// password are optional, so a local test server like MailHog can be used.
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg *MailMessage) error {
+	content, err := msg.Bytes(m.From)
+	if err != nil {
+		return err
+	}
+	// the envelope only takes the address, without the display name the From
+	// header may have.
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	return smtp.SendMail(m.Host+":"+m.Port, auth, from.Address,
+		[]string{msg.To}, content)
+}
+
+// OutboxMailer saves each message as an .eml file in the directory instead of
+// sending it, for development servers.
+type OutboxMailer struct {
+	Directory string
+	From      string
+}
+
+func (m *OutboxMailer) Send(msg *MailMessage) error {
+	content, err := msg.Bytes(m.From)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(m.Directory, 0755); err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	if _, err = rd.Read(suffix); err != nil {
+		return err
+	}
+	filename := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405"),
+		hex.EncodeToString(suffix))
+	return os.WriteFile(filepath.Join(m.Directory, filename), content, 0600)
+}
+
+//go:embed templates
+var mailTemplateFiles embed.FS
+
+var (
+	htmlMailTemplates = htmltemplate.Must(htmltemplate.ParseFS(
+		mailTemplateFiles, "templates/*.html"))
+	textMailTemplates = texttemplate.Must(texttemplate.ParseFS(
+		mailTemplateFiles, "templates/*.txt"))
+)
+
+// mailData provides the values used in the mail templates.
+type mailData struct {
+	Subject string
+	Name    string
+	Email   string
+	Code    string
+	Remote  string
+	Expires string
+}
+
+// MailNotifier delivers the user notices by email, using the templates for
+// each kind of notice.
+type MailNotifier struct {
+	Mailer Mailer
+}
+
+func (n *MailNotifier) SendVerification(user *User, code string,
+	expires time.Time) error {
+	return n.send(user, "verification", "Verify your email address", code, "",
+		expires)
+}
+
+func (n *MailNotifier) SendReset(user *User, code string,
+	expires time.Time) error {
+	return n.send(user, "reset", "Reset your password", code, "", expires)
+}
+
+func (n *MailNotifier) SendRemoteCode(user *User, code string, remote string,
+	expires time.Time) error {
+	return n.send(user, "newremote", "Approve your new device", code, remote,
+		expires)
+}
+
+func (n *MailNotifier) SendWelcome(user *User) error {
+	return n.send(user, "welcome", "Welcome to the SOAP Journal", "", "",
+		time.Time{})
+}
+
+func (n *MailNotifier) SendRegistered(user *User) error {
+	return n.send(user, "registered", "Your email address is already registered",
+		"", "", time.Time{})
+}
+
+func (n *MailNotifier) SendLocked(user *User, until time.Time) error {
+	return n.send(user, "locked", "Your account has been locked", "", "",
+		until)
+}
+
+func (n *MailNotifier) send(user *User, name string, subject string,
+	code string, remote string, expires time.Time) error {
+	data := mailData{
+		Subject: subject,
+		Name:    user.Name.FullName(),
+		Email:   user.Email,
+		Code:    code,
+		Remote:  remote,
+	}
+	if !expires.IsZero() {
+		data.Expires = expires.Format("Jan 2, 2006 at 3:04 PM MST")
+	}
+	var text, html bytes.Buffer
+	if err := textMailTemplates.ExecuteTemplate(&text, name+".txt", data); err != nil {
+		return err
+	}
+	if err := htmlMailTemplates.ExecuteTemplate(&html, name+".html", data); err != nil {
+		return err
+	}
+	return n.Mailer.Send(&MailMessage{
+		To:      user.Email,
+		Subject: subject,
+		Text:    text.String(),
+		HTML:    html.String(),
+	})
+}
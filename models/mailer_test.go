@@ -0,0 +1,245 @@
+package models
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpDelivery is a message received by the test SMTP server.
+type smtpDelivery struct {
+	from string
+	to   []string
+	data []byte
+}
+
+// startSMTPServer function will start an SMTP server on the loopback address
+// that accepts one message, which is sent on the channel.
+func startSMTPServer(t *testing.T) (string, string, <-chan smtpDelivery) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	delivered := make(chan smtpDelivery, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		text := textproto.NewConn(conn)
+		var msg smtpDelivery
+		text.PrintfLine("220 localhost test server")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(line)
+			switch {
+			case strings.HasPrefix(command, "EHLO"),
+				strings.HasPrefix(command, "HELO"):
+				text.PrintfLine("250 localhost")
+			case strings.HasPrefix(command, "MAIL FROM:"):
+				msg.from = strings.Trim(line[len("MAIL FROM:"):], "<> ")
+				text.PrintfLine("250 OK")
+			case strings.HasPrefix(command, "RCPT TO:"):
+				msg.to = append(msg.to, strings.Trim(line[len("RCPT TO:"):],
+					"<> "))
+				text.PrintfLine("250 OK")
+			case command == "DATA":
+				text.PrintfLine("354 end with .")
+				if msg.data, err = text.ReadDotBytes(); err != nil {
+					return
+				}
+				text.PrintfLine("250 OK")
+				delivered <- msg
+			case command == "QUIT":
+				text.PrintfLine("221 bye")
+				return
+			default:
+				text.PrintfLine("250 OK")
+			}
+		}
+	}()
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, port, delivered
+}
+
+// mailParts function will read the message's headers and the decoded
+// bodies of its parts, by content type.
+func mailParts(t *testing.T, data []byte) (mail.Header, map[string]string) {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(
+		msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("message is %s, not multipart/alternative: %v", mediaType, err)
+	}
+	parts := make(map[string]string)
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[part.Header.Get("Content-Type")] = string(body)
+	}
+	return msg.Header, parts
+}
+
+func TestSMTPMailerTemplates(t *testing.T) {
+	user := &User{
+		Email: "zoe@example.com",
+		Name:  Name{First: "Zoë", Last: "Adams"},
+	}
+	expires := time.Date(2021, time.October, 1, 15, 4, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		send    func(n Notifier) error
+		subject string
+		want    []string
+	}{
+		{name: "verification", send: func(n Notifier) error {
+			return n.SendVerification(user, "K3Y9Q2TX", expires)
+		}, subject: "Verify your email address",
+			want: []string{"K3Y9Q2TX", "Oct 1, 2021 at 3:04 PM UTC"}},
+		{name: "reset", send: func(n Notifier) error {
+			return n.SendReset(user, "R7M2ZP4W", expires)
+		}, subject: "Reset your password",
+			want: []string{"R7M2ZP4W", "Oct 1, 2021 at 3:04 PM UTC"}},
+		{name: "new device", send: func(n Notifier) error {
+			return n.SendRemoteCode(user, "D4V1C3X", "203.0.113.7", expires)
+		}, subject: "Approve your new device",
+			want: []string{"D4V1C3X", "203.0.113.7"}},
+		{name: "welcome", send: func(n Notifier) error {
+			return n.SendWelcome(user)
+		}, subject: "Welcome to the SOAP Journal",
+			want: []string{"Your account is ready"}},
+		{name: "registered", send: func(n Notifier) error {
+			return n.SendRegistered(user)
+		}, subject: "Your email address is already registered",
+			want: []string{"already has an account"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, port, delivered := startSMTPServer(t)
+			notifier := &MailNotifier{Mailer: &SMTPMailer{
+				Host: host,
+				Port: port,
+				From: "SOAP Journal <journal@example.org>",
+			}}
+			if err := tt.send(notifier); err != nil {
+				t.Fatal(err)
+			}
+			var msg smtpDelivery
+			select {
+			case msg = <-delivered:
+			case <-time.After(5 * time.Second):
+				t.Fatal("no message delivered")
+			}
+
+			if msg.from != "journal@example.org" ||
+				len(msg.to) != 1 || msg.to[0] != user.Email {
+				t.Errorf("envelope from %q to %v", msg.from, msg.to)
+			}
+			header, parts := mailParts(t, msg.data)
+			if header.Get("From") != "SOAP Journal <journal@example.org>" ||
+				header.Get("To") != user.Email ||
+				header.Get("MIME-Version") != "1.0" {
+				t.Errorf("headers are %v", header)
+			}
+			subject, err := new(mime.WordDecoder).DecodeHeader(
+				header.Get("Subject"))
+			if err != nil || subject != tt.subject {
+				t.Errorf("subject is %q, want %q", subject, tt.subject)
+			}
+			if !strings.HasSuffix(header.Get("Message-ID"), "@example.org>") {
+				t.Errorf("message id is %q", header.Get("Message-ID"))
+			}
+			if _, err = header.Date(); err != nil {
+				t.Error(err)
+			}
+
+			text := parts["text/plain; charset=utf-8"]
+			html := parts["text/html; charset=utf-8"]
+			if len(parts) != 2 || text == "" || html == "" {
+				t.Fatalf("parts are %v", parts)
+			}
+			if strings.Contains(text, "<p>") ||
+				!strings.Contains(html, "<title>"+tt.subject+"</title>") {
+				t.Error("text and html parts mixed up")
+			}
+			for _, body := range []string{text, html} {
+				for _, want := range append(tt.want, "Zoë Adams",
+					user.Email) {
+					if !strings.Contains(body, want) {
+						t.Errorf("%q not in %s", want, body)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestOutboxMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	mailer := &OutboxMailer{Directory: dir, From: "journal@example.org"}
+	err := mailer.Send(&MailMessage{
+		To:      "zoe@example.com",
+		Subject: "Welcome to the SOAP Journal",
+		Text:    "Your account is ready",
+		HTML:    "<p>Your account is ready</p>",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("outbox has %v: %v", files, err)
+	}
+	info, err := os.Stat(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("message file mode is %v", info.Mode().Perm())
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, parts := mailParts(t, data)
+	if header.Get("From") != "journal@example.org" ||
+		header.Get("To") != "zoe@example.com" {
+		t.Errorf("headers are %v", header)
+	}
+	if parts["text/plain; charset=utf-8"] != "Your account is ready" ||
+		parts["text/html; charset=utf-8"] != "<p>Your account is ready</p>" {
+		t.Errorf("parts are %v", parts)
+	}
+}
@@ -1,78 +1,331 @@
 package models
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
+// identityKey is the gin context key the authorized user's identity is kept
+// under.
+const identityKey = "identity"
+
+// readScopeKey and mustChangeKey are the gin context keys AllowReadScope and
+// AllowMustChange mark their routes with.
+const (
+	readScopeKey  = "readscope"
+	mustChangeKey = "mustchange"
+)
+
+// Identity is the user authorized for a request, as given by the claims of
+// the request's access token.  SessionID is the refresh family of the token,
+// or the API key's id, which the user's unlocked journal key is kept under.
+type Identity struct {
+	UserID     string
+	Email      string
+	Editor     bool
+	Roles      []string
+	TwoFactor  bool
+	MustChange bool
+	TokenID    string
+	SessionID  string
+	APIKeyID   string
+	Scopes     []string
+}
+
+// HasScope function will report if the request may use the scope.  Requests
+// authorized with an access token have every scope.
+func (i *Identity) HasScope(scope string) bool {
+	if i.APIKeyID == "" {
+		return true
+	}
+	for _, s := range i.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// GetIdentity function will provide the identity AuthorizeJWT stored for the
+// request, or false if the request wasn't authorized.
+func GetIdentity(c *gin.Context) (*Identity, bool) {
+	value, ok := c.Get(identityKey)
+	if !ok {
+		return nil, false
+	}
+	identity, ok := value.(*Identity)
+	return identity, ok && identity != nil
+}
+
+// AuthorizeJWT function will provide the middleware that authorizes requests
+// with the bearer access token, or with one of the user's API keys.  The
+// token must be valid and must not have been revoked, and every failure stops
+// the request.  Users who must change their password can only use the routes
+// marked with AllowMustChange.  The user's identity is stored in the gin
+// context for the handlers and for permission checks like RequirePermission.
 func AuthorizeJWT(db *gorm.DB, log *LogFile) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		const BEARER_SCHEMA = "Bearer "
+		const BEARER_SCHEMA = "bearer "
 		authHeader := c.GetHeader("Authorization")
-		if len(authHeader) > len(BEARER_SCHEMA) {
-			tokenString := authHeader[len(BEARER_SCHEMA):]
-			creds := new(Credentials)
-			token, err := creds.ValidateToken(tokenString)
-			if token.Valid {
-				claims := creds.GetClaims(token.Claims.(jwt.MapClaims))
-				var dbToken Token
-				db.Find(&dbToken, "id = ?", claims.Uuid)
-				if dbToken.Expires.Before(time.Now()) {
-					c.AbortWithStatus(http.StatusUnauthorized)
-				}
-				c.Writer.Header().Set("userid", claims.Id)
-				editor := "user"
-				if claims.Editor {
-					editor = "editor"
-				}
-				c.Writer.Header().Set("roles", editor)
-				c.Next()
-				return
-			}
+		if len(authHeader) <= len(BEARER_SCHEMA) ||
+			strings.ToLower(authHeader[:len(BEARER_SCHEMA)]) != BEARER_SCHEMA {
+			log.WriteToLog("No Authorization header")
+			abortUnauthorized(c, "Authorization Required")
+			return
+		}
+		tokenString := strings.TrimSpace(authHeader[len(BEARER_SCHEMA):])
+		if IsAPIKey(tokenString) {
+			authorizeAPIKey(c, db, log, tokenString)
+			return
+		}
+		creds := new(Credentials)
+		claims, errMsg := creds.ValidateToken(tokenString)
+		if errMsg != nil {
+			log.WriteToLog(fmt.Sprintf("%s %v", errMsg.String(),
+				errMsg.Details))
+			c.AbortWithStatusJSON(int(errMsg.StatusCode), errMsg)
+			return
+		}
+
+		var dbToken Token
+		err := db.First(&dbToken, "id = ?", claims.Uuid).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			log.WriteToLog(fmt.Sprintf("Revoked Token: %s", claims.Uuid))
+			abortUnauthorized(c, "Token Revoked")
+			return
+		} else if err != nil {
 			log.WriteToLog(err.Error())
-			c.AbortWithStatus(http.StatusUnauthorized)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, &ErrorMessage{
+				ErrorType:  "database",
+				StatusCode: http.StatusInternalServerError,
+				Message:    "database error",
+			})
+			return
+		}
+		if dbToken.UserID != claims.Id || dbToken.Expires.Before(time.Now()) {
+			abortUnauthorized(c, "Token Expired")
 			return
 		}
-		log.WriteToLog("No Authorization header")
-		c.AbortWithStatus(http.StatusUnauthorized)
+		if claims.MustChange && !c.GetBool(mustChangeKey) {
+			abortMustChange(c)
+			return
+		}
+
+		c.Set(identityKey, &Identity{
+			UserID:     claims.Id,
+			Email:      claims.Email,
+			Editor:     claims.Editor,
+			Roles:      claims.Roles,
+			TwoFactor:  claims.TwoFactor,
+			MustChange: claims.MustChange,
+			TokenID:    claims.Uuid,
+			SessionID:  dbToken.FamilyID,
+		})
+		c.Next()
 	}
 }
 
-func AuthorizeEditor(db *gorm.DB, log *LogFile) gin.HandlerFunc {
+// RequirePermission function will provide the middleware that only allows
+// users with a role granting the permission, used after AuthorizeJWT.  The
+// roles are checked on each request, so a removed role takes effect at
+// once.  Users must also have two-factor authentication when
+// RequireEditorTOTP is set.
+func RequirePermission(db *gorm.DB, log *LogFile, perm string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		const BEARER_SCHEMA = "Bearer "
-		authHeader := c.GetHeader("Authorization")
-		if len(authHeader) > len(BEARER_SCHEMA) {
-			tokenString := authHeader[len(BEARER_SCHEMA):]
-			creds := new(Credentials)
-			token, err := creds.ValidateToken(tokenString)
-			if token.Valid {
-				claims := creds.GetClaims(token.Claims.(jwt.MapClaims))
-				var dbToken Token
-				db.Find(&dbToken, "id = ?", claims.Uuid)
-				if dbToken.Expires.Before(time.Now()) {
-					c.AbortWithStatus(http.StatusUnauthorized)
-					return
-				}
-				if !claims.Editor {
-					c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-						"error": "Not Editor",
-					})
-					return
-				}
-				c.Writer.Header().Set("userid", claims.Id)
-				c.Next()
-				return
-			}
+		identity, ok := GetIdentity(c)
+		if !ok {
+			abortUnauthorized(c, "Authorization Required")
+			return
+		}
+		var count int64
+		err := db.Table("user_roles").
+			Joins("JOIN role_permissions ON role_permissions.role = user_roles.role").
+			Where("user_roles.userid = ? AND role_permissions.permission = ?",
+				identity.UserID, perm).
+			Count(&count).Error
+		if err != nil {
 			log.WriteToLog(err.Error())
-			c.AbortWithStatus(http.StatusUnauthorized)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, &ErrorMessage{
+				ErrorType:  "database",
+				StatusCode: http.StatusInternalServerError,
+				Message:    "database error",
+			})
+			return
+		}
+		if count == 0 || !identity.HasScope(ScopeAdmin) {
+			log.WriteToLog(fmt.Sprintf("Permission Denied: %s - %s %s %s",
+				identity.Email, perm, c.Request.Method, c.Request.URL.Path))
+			c.AbortWithStatusJSON(http.StatusForbidden, &ErrorMessage{
+				ErrorType:  "authorization",
+				StatusCode: http.StatusForbidden,
+				Message:    "Permission Denied",
+				Details:    []string{perm},
+			})
 			return
 		}
-		log.WriteToLog("No Authorization header")
-		c.AbortWithStatus(http.StatusUnauthorized)
+		if RequireEditorTOTP && !identity.TwoFactor {
+			c.AbortWithStatusJSON(http.StatusForbidden, &ErrorMessage{
+				ErrorType:  "authorization",
+				StatusCode: http.StatusForbidden,
+				Message:    "Two-Factor Required",
+			})
+			return
+		}
+		c.Next()
 	}
 }
+
+// authorizeAPIKey function will authorize the request with the API key.  The
+// key must match, must not have expired and its scopes must allow the
+// request, and the key's user must not be locked.
+func authorizeAPIKey(c *gin.Context, db *gorm.DB, log *LogFile,
+	encoded string) {
+	id, secret, err := ParseAPIKey(encoded)
+	if err != nil {
+		abortUnauthorized(c, "Invalid API Key")
+		return
+	}
+	var key APIKey
+	err = db.First(&key, "id = ?", id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) ||
+		(err == nil && !key.Matches(secret)) {
+		log.WriteToLog(fmt.Sprintf("Invalid API Key: %s from %s", id,
+			c.ClientIP()))
+		abortUnauthorized(c, "Invalid API Key")
+		return
+	}
+	var user User
+	if err == nil {
+		err = db.Preload("Creds").Preload("Roles").
+			First(&user, "id = ?", key.UserID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// the key's user was removed
+			log.WriteToLog(fmt.Sprintf("Invalid API Key: %s from %s", id,
+				c.ClientIP()))
+			abortUnauthorized(c, "Invalid API Key")
+			return
+		}
+	}
+	if err != nil {
+		log.WriteToLog(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, &ErrorMessage{
+			ErrorType:  "database",
+			StatusCode: http.StatusInternalServerError,
+			Message:    "database error",
+		})
+		return
+	}
+	if key.Expires.Before(time.Now()) {
+		abortUnauthorized(c, "API Key Expired")
+		return
+	}
+	if user.Creds.IsLocked() || user.Creds.PendingApproval {
+		abortUnauthorized(c, "Account Locked")
+		return
+	}
+	if user.Creds.MustChange && !c.GetBool(mustChangeKey) {
+		abortMustChange(c)
+		return
+	}
+	if !key.Allows(c.Request.Method) &&
+		!(c.GetBool(readScopeKey) && key.HasScope(ScopeRead)) {
+		c.AbortWithStatusJSON(http.StatusForbidden, &ErrorMessage{
+			ErrorType:  "authorization",
+			StatusCode: http.StatusForbidden,
+			Message:    "API key scope doesn't allow this request",
+		})
+		return
+	}
+
+	// the last use is only saved once a minute, so a busy script doesn't
+	// write on every request.
+	if time.Since(key.LastUsed) > time.Minute || key.LastUsedIP != c.ClientIP() {
+		err = db.Model(&key).Updates(map[string]interface{}{
+			"lastused":   time.Now(),
+			"lastusedip": c.ClientIP(),
+		}).Error
+		if err != nil {
+			log.WriteToLog(err.Error())
+		}
+	}
+	c.Set(identityKey, &Identity{
+		UserID:    user.ID,
+		Email:     user.Email,
+		Editor:    user.HasRole(RoleEditor),
+		Roles:     user.RoleNames(),
+		TwoFactor: user.Creds.TOTPEnabled,
+		SessionID: key.ID,
+		APIKeyID:  key.ID,
+		Scopes:    strings.Fields(key.Scopes),
+	})
+	c.Next()
+}
+
+// AllowReadScope function will provide the middleware that lets API keys
+// with only the read scope make the request whatever its method, used before
+// AuthorizeJWT for the routes that change nothing but the key's own session,
+// like unlocking the journal.
+func AllowReadScope() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(readScopeKey, true)
+		c.Next()
+	}
+}
+
+// AllowMustChange function will provide the middleware that lets users who
+// must change their password make the request, used before AuthorizeJWT for
+// the routes needed to change it or sign out.
+func AllowMustChange() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(mustChangeKey, true)
+		c.Next()
+	}
+}
+
+// RequireSession function will provide the middleware that only allows
+// requests authorized with an access token, used after AuthorizeJWT for the
+// routes that manage the user's credentials, so an API key can't be used to
+// take over the account.
+func RequireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identity, ok := GetIdentity(c)
+		if !ok {
+			abortUnauthorized(c, "Authorization Required")
+			return
+		}
+		if identity.APIKeyID != "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, &ErrorMessage{
+				ErrorType:  "authorization",
+				StatusCode: http.StatusForbidden,
+				Message:    "API keys can't be used for this request",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+func abortMustChange(c *gin.Context) {
+	c.AbortWithStatusJSON(http.StatusForbidden, &ErrorMessage{
+		ErrorType:  "authorization",
+		StatusCode: http.StatusForbidden,
+		Message:    "Password Change Required",
+		Details: []string{
+			"Change the password at /api/v1/user/password, then refresh the tokens",
+		},
+	})
+}
+
+func abortUnauthorized(c *gin.Context, message string) {
+	c.AbortWithStatusJSON(http.StatusUnauthorized, &ErrorMessage{
+		ErrorType:  "authorization",
+		StatusCode: http.StatusUnauthorized,
+		Message:    message,
+	})
+}
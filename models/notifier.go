@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+)
+
+// Notifier delivers the one-time codes and notices for a user's account, so
+// the handlers don't need to know how the user is reached.
+type Notifier interface {
+	SendVerification(user *User, code string, expires time.Time) error
+	SendReset(user *User, code string, expires time.Time) error
+	SendRemoteCode(user *User, code string, remote string,
+		expires time.Time) error
+	SendWelcome(user *User) error
+	SendRegistered(user *User) error
+	SendLocked(user *User, until time.Time) error
+}
@@ -0,0 +1,444 @@
+package models
+
+import (
+	rd "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+)
+
+// OIDC provides the external identity provider members can sign in with, or
+// nil when OpenID Connect isn't configured.  OIDCProvision allows accounts to
+// be created for verified email addresses that don't have one, and
+// OIDCStateLife provides how long a sign in can take at the provider.
+var (
+	OIDC          *OIDCProvider
+	OIDCProvision = false
+	OIDCStateLife = time.Minute * 10
+)
+
+// oidcAlgorithms are the signatures accepted on the provider's ID tokens.
+var oidcAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384",
+	"PS512", "ES256", "ES384", "EdDSA"}
+
+// OIDCProvider is an OpenID Connect identity provider the API is registered
+// with as a client.  The provider's endpoints are read from its discovery
+// document the first time they are needed, and its signing keys are read
+// again when a token is signed with a key that isn't known.
+type OIDCProvider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	Client       *http.Client
+
+	mu       sync.Mutex
+	metadata *oidcMetadata
+	keys     map[string]interface{}
+	fetched  time.Time
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// NewOIDCProvider function will create the provider for the issuer, with the
+// client registered there.  The redirect address is the page of the web
+// application that receives the provider's response.
+func NewOIDCProvider(issuer string, clientID string, clientSecret string,
+	redirectURL string) *OIDCProvider {
+	return &OIDCProvider{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"openid", "email", "profile"},
+		Client:       &http.Client{Timeout: time.Second * 10},
+		keys:         make(map[string]interface{}),
+	}
+}
+
+// OIDCState holds what is needed to finish a sign in started with the
+// provider: the state given to the provider, the nonce expected in the ID
+// token, the PKCE code verifier and the hash of the secret kept by the
+// browser that started the sign in, so the provider's response can't be
+// used from another browser.  UserID is set once the provider's sign in was
+// checked and only the user's two-factor code is left.
+type OIDCState struct {
+	ID       string    `json:"-" gorm:"primaryKey;column:id"`
+	Nonce    string    `json:"-" gorm:"column:nonce"`
+	Verifier string    `json:"-" gorm:"column:verifier"`
+	Binding  string    `json:"-" gorm:"column:binding"`
+	UserID   string    `json:"-" gorm:"column:userid"`
+	Expires  time.Time `json:"-" gorm:"column:expires"`
+}
+
+func (OIDCState) TableName() string {
+	return "user_oidc_states"
+}
+
+// NewOIDCState function will create the random values for a sign in, which
+// expires after OIDCStateLife, providing the secret the browser must keep
+// to finish the sign in.
+func NewOIDCState() (*OIDCState, string, error) {
+	values := make([]string, 4)
+	for i := range values {
+		data := make([]byte, 32)
+		if _, err := rd.Read(data); err != nil {
+			return nil, "", err
+		}
+		values[i] = base64.RawURLEncoding.EncodeToString(data)
+	}
+	return &OIDCState{
+		ID:       values[0],
+		Nonce:    values[1],
+		Verifier: values[2],
+		Binding:  oidcBinding(values[3]),
+		Expires:  time.Now().Add(OIDCStateLife),
+	}, values[3], nil
+}
+
+// BoundTo function will report if the secret is the one kept by the browser
+// that started the sign in.
+func (st *OIDCState) BoundTo(secret string) bool {
+	return secret != "" && subtle.ConstantTimeCompare(
+		[]byte(oidcBinding(secret)), []byte(st.Binding)) == 1
+}
+
+func oidcBinding(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// OIDCLink connects an account at the provider, given by its issuer and
+// subject, to a user.
+type OIDCLink struct {
+	Issuer            string    `json:"issuer" gorm:"primaryKey;column:issuer"`
+	Subject           string    `json:"-" gorm:"primaryKey;column:subject"`
+	CredentialsUserID string    `json:"-" gorm:"column:userid;index"`
+	Email             string    `json:"email" gorm:"column:email"`
+	Created           time.Time `json:"created" gorm:"column:created"`
+	LastUsed          time.Time `json:"lastused" gorm:"column:lastused"`
+}
+
+func (OIDCLink) TableName() string {
+	return "user_oidc_links"
+}
+
+// OIDCClaims are the claims of the provider's ID token the API uses.
+type OIDCClaims struct {
+	jwt.RegisteredClaims
+	Nonce           string `json:"nonce"`
+	AuthorizedParty string `json:"azp"`
+	Email           string `json:"email"`
+	EmailVerified   bool   `json:"email_verified"`
+	Name            string `json:"name"`
+	GivenName       string `json:"given_name"`
+	MiddleName      string `json:"middle_name"`
+	FamilyName      string `json:"family_name"`
+}
+
+// AuthURL function will provide the address of the provider's sign in page
+// for the state, asking for an authorization code protected with PKCE.
+func (p *OIDCProvider) AuthURL(st *OIDCState) (string, error) {
+	meta, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {st.ID},
+		"nonce":                 {st.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return meta.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange function will trade the authorization code from the provider for
+// its tokens, then check the ID token's signature, issuer, audience,
+// expiration and nonce, providing the token's claims.
+func (p *OIDCProvider) Exchange(st *OIDCState, code string) (*OIDCClaims,
+	*ErrorMessage) {
+	meta, err := p.discover()
+	if err != nil {
+		return nil, oidcError(err)
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {st.Verifier},
+	}
+	if p.ClientSecret == "" {
+		form.Set("client_id", p.ClientID)
+	}
+	req, err := http.NewRequest(http.MethodPost, meta.TokenEndpoint,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, oidcError(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID),
+			url.QueryEscape(p.ClientSecret))
+	}
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err = p.fetchJSON(req, &tokens); err != nil && tokens.Error == "" {
+		return nil, oidcError(err)
+	}
+	if tokens.Error != "" {
+		return nil, oidcError(fmt.Errorf("token request failed: %s",
+			strings.TrimSpace(tokens.Error+" "+tokens.ErrorDescription)))
+	}
+	if tokens.IDToken == "" {
+		return nil, oidcError(errors.New("no id token in the response"))
+	}
+
+	claims := new(OIDCClaims)
+	parser := jwt.NewParser(jwt.WithValidMethods(oidcAlgorithms))
+	_, err = parser.ParseWithClaims(tokens.IDToken, claims,
+		func(token *jwt.Token) (interface{}, error) {
+			kid, _ := token.Header["kid"].(string)
+			return p.key(meta, kid)
+		})
+	if err == nil {
+		err = claims.check(meta.Issuer, p.ClientID, st.Nonce)
+	}
+	if err != nil {
+		return nil, oidcError(err)
+	}
+	return claims, nil
+}
+
+// check function will check the ID token's claims that the parser doesn't.
+func (c *OIDCClaims) check(issuer string, clientID string,
+	nonce string) error {
+	switch {
+	case c.Issuer != issuer:
+		return errors.New("id token issuer mismatch")
+	case !c.VerifyAudience(clientID, true):
+		return errors.New("id token audience mismatch")
+	case len(c.Audience) > 1 && c.AuthorizedParty != clientID:
+		return errors.New("id token authorized party mismatch")
+	case c.ExpiresAt == nil:
+		return errors.New("id token has no expiration")
+	case c.Nonce != nonce:
+		return errors.New("id token nonce mismatch")
+	case c.Subject == "":
+		return errors.New("id token has no subject")
+	}
+	return nil
+}
+
+// HasVerifiedEmail function will report if the provider vouches for the
+// email address, which is required to link or create an account by it.
+func (c *OIDCClaims) HasVerifiedEmail() bool {
+	return c.Email != "" && c.EmailVerified
+}
+
+// NewOIDCUser function will create an account for a member who signed in
+// with the provider.  The account has no password, so the member signs in
+// with the provider until they set one with the forgot password process.
+func NewOIDCUser(claims *OIDCClaims) *User {
+	first, last := claims.GivenName, claims.FamilyName
+	if first == "" && last == "" {
+		parts := strings.Fields(claims.Name)
+		if len(parts) > 0 {
+			first, last = parts[0], strings.Join(parts[1:], " ")
+		}
+	}
+	if first == "" {
+		first = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+	user := User{
+		ID:    uuid.NewString(),
+		Email: claims.Email,
+		Name: Name{
+			First:  first,
+			Middle: claims.MiddleName,
+			Last:   last,
+		},
+	}
+	user.Name.UserID = user.ID
+	user.Creds.UserID = user.ID
+	user.Creds.Verified = time.Now()
+	user.Creds.PendingApproval = RegistrationMode == RegistrationApproval
+	return &user
+}
+
+// NewLink function will create the link between the provider's account and
+// the user.
+func (c *OIDCClaims) NewLink(userID string) *OIDCLink {
+	return &OIDCLink{
+		Issuer:            c.Issuer,
+		Subject:           c.Subject,
+		CredentialsUserID: userID,
+		Email:             c.Email,
+		Created:           time.Now(),
+		LastUsed:          time.Now(),
+	}
+}
+
+// LogInOIDC function will check a sign in with the identity provider, like
+// LogIn does for the password.  The provider has checked the member, so only
+// the account's lock and approval are checked here, and an address the
+// provider verified completes the email verification.  Accounts with
+// two-factor authentication must still give their code after, as they do
+// with the password.
+func (c *Credentials) LogInOIDC(email string, claims *OIDCClaims) (bool,
+	*ErrorMessage) {
+	if c.IsLocked() {
+		return false, c.lockedError()
+	}
+	if c.PendingApproval {
+		return false, &ErrorMessage{
+			ErrorType:  "credentials",
+			StatusCode: 401,
+			Message:    "Account Pending Approval",
+		}
+	}
+	if !c.IsVerified() {
+		if !claims.HasVerifiedEmail() || !strings.EqualFold(email, claims.Email) {
+			return false, &ErrorMessage{
+				ErrorType:  "credentials",
+				StatusCode: 401,
+				Message:    "Account Not Verified",
+			}
+		}
+		c.Verified = time.Now()
+		c.VerificationToken = ""
+	}
+	if !c.TOTPEnabled {
+		c.BadAttempts = 0
+		c.LockCount = 0
+	}
+	return true, nil
+}
+
+// discover function will read the provider's discovery document, once.
+func (p *OIDCProvider) discover() (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+	req, err := http.NewRequest(http.MethodGet,
+		p.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	meta := new(oidcMetadata)
+	if err = p.fetchJSON(req, meta); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(meta.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("discovery issuer %s doesn't match", meta.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" ||
+		meta.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing endpoints")
+	}
+	p.metadata = meta
+	return meta, nil
+}
+
+// key function will provide the provider's key with the identifier.  The
+// keys are read again when the identifier isn't known, at most once a
+// minute, so the provider can rotate its keys.
+func (p *OIDCProvider) key(meta *oidcMetadata, kid string) (interface{},
+	error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.fetched) > time.Minute {
+		p.fetched = time.Now()
+		req, err := http.NewRequest(http.MethodGet, meta.JWKSURI, nil)
+		if err != nil {
+			return nil, err
+		}
+		var set JSONWebKeySet
+		if err = p.fetchJSON(req, &set); err != nil {
+			return nil, err
+		}
+		keys := make(map[string]interface{})
+		for _, jwk := range set.Keys {
+			if jwk.Use != "" && jwk.Use != "sig" {
+				continue
+			}
+			if key, err := jwk.PublicKey(); err == nil {
+				keys[jwk.Kid] = key
+			}
+		}
+		p.keys = keys
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	// a provider with a single key may not name it in its tokens.
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown provider key %s", kid)
+}
+
+// fetchJSON function will send the request to the provider and decode its
+// JSON response, which is decoded for error responses too.
+func (p *OIDCProvider) fetchJSON(req *http.Request, value interface{}) error {
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	jsonErr := json.Unmarshal(body, value)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	return jsonErr
+}
+
+func oidcError(err error) *ErrorMessage {
+	return &ErrorMessage{
+		ErrorType:  "oidc",
+		StatusCode: http.StatusUnauthorized,
+		Message:    "OpenID Connect sign in failed",
+		Details:    []string{err.Error()},
+	}
+}
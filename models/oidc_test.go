@@ -0,0 +1,384 @@
+package models
+
+import (
+	"crypto/ed25519"
+	rd "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// mockIdP is an OpenID Connect identity provider serving its discovery
+// document, its keys and its token endpoint, used to run sign ins without a
+// real provider.
+type mockIdP struct {
+	server   *httptest.Server
+	key      ed25519.PrivateKey
+	kid      string
+	clientID string
+	secret   string
+
+	mu     sync.Mutex
+	grants map[string]url.Values
+	// claims changes the ID token's claims before it is signed.
+	claims func(*OIDCClaims)
+	// signer signs the ID token in place of the published key.
+	signer ed25519.PrivateKey
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rd.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{
+		key:      key,
+		kid:      "idp-key",
+		clientID: "soap-client",
+		secret:   "soap-secret",
+		grants:   make(map[string]url.Values),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration",
+		func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(oidcMetadata{
+				Issuer:                idp.server.URL,
+				AuthorizationEndpoint: idp.server.URL + "/authorize",
+				TokenEndpoint:         idp.server.URL + "/token",
+				JWKSURI:               idp.server.URL + "/jwks",
+			})
+		})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(JSONWebKeySet{Keys: []JSONWebKey{{
+			Kty: "OKP",
+			Kid: idp.kid,
+			Use: "sig",
+			Alg: "EdDSA",
+			Crv: "Ed25519",
+			X: base64.RawURLEncoding.EncodeToString(
+				idp.key.Public().(ed25519.PublicKey)),
+		}}})
+	})
+	mux.HandleFunc("/token", idp.token)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// provider function will provide the API's client of the provider.
+func (idp *mockIdP) provider() *OIDCProvider {
+	p := NewOIDCProvider(idp.server.URL, idp.clientID, idp.secret,
+		"https://app.example/oidc")
+	p.Client = idp.server.Client()
+	return p
+}
+
+// authorize function will sign the member in at the provider's sign in page,
+// providing the code sent back to the web application.
+func (idp *mockIdP) authorize(t *testing.T, authURL string) string {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" ||
+		query.Get("client_id") != idp.clientID {
+		t.Fatalf("bad authorization request %s", authURL)
+	}
+	code := make([]byte, 16)
+	rd.Read(code)
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.grants[base64.RawURLEncoding.EncodeToString(code)] = query
+	return base64.RawURLEncoding.EncodeToString(code)
+}
+
+// token function will trade a code for the ID token, checking the client
+// and the PKCE code verifier.  Each code can only be used once.
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	fail := func(reason string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": reason})
+	}
+	r.ParseForm()
+	id, secret, _ := r.BasicAuth()
+	if id != idp.clientID || secret != idp.secret {
+		fail("invalid_client")
+		return
+	}
+	idp.mu.Lock()
+	grant, ok := idp.grants[r.PostForm.Get("code")]
+	delete(idp.grants, r.PostForm.Get("code"))
+	idp.mu.Unlock()
+	if !ok || r.PostForm.Get("grant_type") != "authorization_code" ||
+		r.PostForm.Get("redirect_uri") != grant.Get("redirect_uri") {
+		fail("invalid_grant")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) !=
+		grant.Get("code_challenge") {
+		fail("invalid_grant")
+		return
+	}
+	claims := &OIDCClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    idp.server.URL,
+			Subject:   "member-1",
+			Audience:  jwt.ClaimStrings{idp.clientID},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+		Nonce:         grant.Get("nonce"),
+		Email:         "member@example.com",
+		EmailVerified: true,
+		GivenName:     "Mary",
+		FamilyName:    "Smith",
+	}
+	if idp.claims != nil {
+		idp.claims(claims)
+	}
+	signer := idp.key
+	if idp.signer != nil {
+		signer = idp.signer
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = idp.kid
+	signed, err := token.SignedString(signer)
+	if err != nil {
+		fail("server_error")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"id_token":     signed,
+	})
+}
+
+// signIn function will start a sign in, sign the member in at the provider
+// and finish the sign in with the provider's code.
+func (idp *mockIdP) signIn(t *testing.T, p *OIDCProvider) (*OIDCClaims,
+	*ErrorMessage) {
+	t.Helper()
+	st, _, err := NewOIDCState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := p.AuthURL(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.Exchange(st, idp.authorize(t, authURL))
+}
+
+func TestOIDCExchange(t *testing.T) {
+	idp := newMockIdP(t)
+	claims, errMsg := idp.signIn(t, idp.provider())
+	if errMsg != nil {
+		t.Fatalf("sign in failed: %s %v", errMsg.String(), errMsg.Details)
+	}
+	if claims.Subject != "member-1" || claims.Issuer != idp.server.URL ||
+		!claims.HasVerifiedEmail() {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+}
+
+func TestOIDCExchangeRejects(t *testing.T) {
+	_, otherKey, _ := ed25519.GenerateKey(rd.Reader)
+	tests := []struct {
+		name   string
+		claims func(*OIDCClaims)
+		signer ed25519.PrivateKey
+		want   string
+	}{
+		{name: "nonce", want: "nonce mismatch",
+			claims: func(c *OIDCClaims) { c.Nonce = "replayed" }},
+		{name: "issuer", want: "issuer mismatch",
+			claims: func(c *OIDCClaims) { c.Issuer = "https://evil.example" }},
+		{name: "audience", want: "audience mismatch",
+			claims: func(c *OIDCClaims) {
+				c.Audience = jwt.ClaimStrings{"other-client"}
+			}},
+		{name: "authorized party", want: "authorized party mismatch",
+			claims: func(c *OIDCClaims) {
+				c.Audience = append(c.Audience, "other-client")
+				c.AuthorizedParty = "other-client"
+			}},
+		{name: "expired", want: "expired",
+			claims: func(c *OIDCClaims) {
+				c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+			}},
+		{name: "no expiration", want: "no expiration",
+			claims: func(c *OIDCClaims) { c.ExpiresAt = nil }},
+		{name: "no subject", want: "no subject",
+			claims: func(c *OIDCClaims) { c.Subject = "" }},
+		{name: "signature", want: "verification error", signer: otherKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newMockIdP(t)
+			idp.claims, idp.signer = tt.claims, tt.signer
+			_, errMsg := idp.signIn(t, idp.provider())
+			if errMsg == nil {
+				t.Fatal("sign in accepted")
+			}
+			if len(errMsg.Details) == 0 ||
+				!strings.Contains(errMsg.Details[0], tt.want) {
+				t.Errorf("got %v, want %q", errMsg.Details, tt.want)
+			}
+		})
+	}
+}
+
+func TestOIDCExchangeChecksCode(t *testing.T) {
+	idp := newMockIdP(t)
+	p := idp.provider()
+	st, _, _ := NewOIDCState()
+	authURL, err := p.AuthURL(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := idp.authorize(t, authURL)
+
+	// another sign in's verifier must not get the code's tokens.
+	other, _, _ := NewOIDCState()
+	other.Nonce = st.Nonce
+	if _, errMsg := p.Exchange(other, code); errMsg == nil {
+		t.Error("code accepted with the wrong verifier")
+	}
+	code = idp.authorize(t, authURL)
+	if _, errMsg := p.Exchange(st, code); errMsg != nil {
+		t.Fatalf("sign in failed: %v", errMsg.Details)
+	}
+	if _, errMsg := p.Exchange(st, code); errMsg == nil {
+		t.Error("code accepted twice")
+	}
+
+	idp.secret = "changed"
+	if _, errMsg := idp.signIn(t, p); errMsg == nil {
+		t.Error("sign in accepted with the wrong client secret")
+	}
+}
+
+func TestOIDCDiscoveryIssuer(t *testing.T) {
+	idp := newMockIdP(t)
+	p := NewOIDCProvider(idp.server.URL+"/other", idp.clientID, idp.secret,
+		"https://app.example/oidc")
+	p.Client = idp.server.Client()
+	st, _, _ := NewOIDCState()
+	if _, err := p.AuthURL(st); err == nil {
+		t.Error("discovery accepted for another issuer")
+	}
+}
+
+func TestOIDCStateBinding(t *testing.T) {
+	st, secret, err := NewOIDCState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.BoundTo(secret) {
+		t.Error("state not bound to its browser's secret")
+	}
+	other, otherSecret, _ := NewOIDCState()
+	for _, s := range []string{"", otherSecret, st.Binding} {
+		if st.BoundTo(s) {
+			t.Errorf("state bound to %q", s)
+		}
+	}
+	if st.ID == other.ID || st.Nonce == st.Verifier {
+		t.Error("state values repeat")
+	}
+}
+
+func TestOIDCLinkAndProvision(t *testing.T) {
+	idp := newMockIdP(t)
+	idp.claims = func(c *OIDCClaims) {
+		c.GivenName, c.FamilyName = "", ""
+		c.Name = "Mary Ann Smith"
+	}
+	claims, errMsg := idp.signIn(t, idp.provider())
+	if errMsg != nil {
+		t.Fatalf("sign in failed: %v", errMsg.Details)
+	}
+
+	mode := RegistrationMode
+	defer func() { RegistrationMode = mode }()
+	RegistrationMode = RegistrationApproval
+	user := NewOIDCUser(claims)
+	if user.Email != claims.Email || user.Creds.UserID != user.ID ||
+		user.Name.UserID != user.ID {
+		t.Errorf("user not set up: %+v", user)
+	}
+	if user.Name.First != "Mary" || user.Name.Last != "Ann Smith" {
+		t.Errorf("name %+v", user.Name)
+	}
+	if !user.Creds.IsVerified() || !user.Creds.PendingApproval ||
+		user.Creds.Password != "" {
+		t.Errorf("credentials %+v", user.Creds)
+	}
+
+	link := claims.NewLink(user.ID)
+	if link.Issuer != idp.server.URL || link.Subject != "member-1" ||
+		link.CredentialsUserID != user.ID || link.Email != claims.Email {
+		t.Errorf("link %+v", link)
+	}
+
+	claims.Name = ""
+	if user = NewOIDCUser(claims); user.Name.First != "member" {
+		t.Errorf("name from the email address %+v", user.Name)
+	}
+}
+
+func TestLogInOIDC(t *testing.T) {
+	verified := &OIDCClaims{Email: "member@example.com", EmailVerified: true}
+	tests := []struct {
+		name     string
+		creds    Credentials
+		email    string
+		claims   *OIDCClaims
+		ok       bool
+		verifies bool
+	}{
+		{name: "verified", creds: Credentials{Verified: time.Now(),
+			BadAttempts: 2}, claims: &OIDCClaims{}, ok: true},
+		{name: "locked", creds: Credentials{Verified: time.Now(),
+			Locked: true}, claims: verified},
+		{name: "pending", creds: Credentials{Verified: time.Now(),
+			PendingApproval: true}, claims: verified},
+		{name: "provider verifies", claims: verified, ok: true, verifies: true},
+		{name: "other address", email: "other@example.com", claims: verified},
+		{name: "unverified address", claims: &OIDCClaims{
+			Email: "member@example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			email := tt.email
+			if email == "" {
+				email = "Member@Example.com"
+			}
+			creds := tt.creds
+			ok, errMsg := creds.LogInOIDC(email, tt.claims)
+			if ok != tt.ok || (errMsg == nil) != tt.ok {
+				t.Fatalf("got %v %v, want %v", ok, errMsg, tt.ok)
+			}
+			if tt.ok && creds.BadAttempts != 0 {
+				t.Error("bad attempts not cleared")
+			}
+			if tt.verifies && !creds.IsVerified() {
+				t.Error("email address not verified")
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package models
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordPolicy provides the rules a new password must meet.  MinClasses is
+// the number of character classes (lower case, upper case, digits and
+// symbols) the password must use, History the number of previous passwords
+// that can't be reused, and Common the list of passwords too well known to
+// be used.
+type PasswordPolicy struct {
+	MinLength  int
+	MinClasses int
+	History    int
+	Cost       int
+	Common     map[string]bool
+}
+
+// Passwords provides the password policy used by Credentials.SetPassword.
+var Passwords = PasswordPolicy{
+	MinLength:  10,
+	MinClasses: 3,
+	History:    5,
+	Cost:       12,
+	Common:     map[string]bool{},
+}
+
+// LoadCommon function will load the list of common or breached passwords from
+// the file, which has one password per line.
+func (p *PasswordPolicy) LoadCommon(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	common := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			common[strings.ToLower(line)] = true
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	p.Common = common
+	return nil
+}
+
+// Check function will provide a description of each rule the password fails,
+// or an empty list if the password meets the policy.
+func (p *PasswordPolicy) Check(passwd string) []string {
+	failures := make([]string, 0)
+	if len([]rune(passwd)) < p.MinLength {
+		failures = append(failures,
+			fmt.Sprintf("must be at least %d characters", p.MinLength))
+	}
+	if len(passwd) > 72 {
+		failures = append(failures, "must be at most 72 bytes")
+	}
+	var lower, upper, digit, symbol int
+	for _, r := range passwd {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	if lower+upper+digit+symbol < p.MinClasses {
+		failures = append(failures, fmt.Sprintf(
+			"must use at least %d of lower case, upper case, digits and symbols",
+			p.MinClasses))
+	}
+	if p.Common[strings.ToLower(passwd)] {
+		failures = append(failures, "is too common")
+	}
+	return failures
+}
+
+// PasswordHistory keeps the hash of a user's previous password, so it can't be
+// used again.
+type PasswordHistory struct {
+	ID                uint64    `json:"-" gorm:"primaryKey;column:id;autoIncrement"`
+	CredentialsUserID string    `json:"-" gorm:"column:userid;index"`
+	Hash              string    `json:"-" gorm:"column:hash"`
+	Created           time.Time `json:"-" gorm:"column:created"`
+}
+
+func (PasswordHistory) TableName() string {
+	return "user_password_history"
+}
+
+// ByPasswordHistory will provide the sort interface methods for sorting the
+// previous passwords with the latest first.
+type ByPasswordHistory []PasswordHistory
+
+func (s ByPasswordHistory) Len() int      { return len(s) }
+func (s ByPasswordHistory) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s ByPasswordHistory) Less(i, j int) bool {
+	return s[i].Created.After(s[j].Created)
+}
+
+// usedBefore function will report if the password matches the current
+// password or one of the previous passwords kept by the policy.
+func (c *Credentials) usedBefore(passwd string) bool {
+	if Passwords.History < 1 {
+		return false
+	}
+	if c.Password != "" &&
+		bcrypt.CompareHashAndPassword([]byte(c.Password), []byte(passwd)) == nil {
+		return true
+	}
+	for i, prev := range c.History {
+		if i >= Passwords.History-1 {
+			break
+		}
+		if bcrypt.CompareHashAndPassword([]byte(prev.Hash), []byte(passwd)) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// policyError function will provide the error message listing the rules the
+// password failed.
+func policyError(failures []string) *ErrorMessage {
+	details := make([]string, 0)
+	for _, failure := range failures {
+		details = append(details, "Password "+failure)
+	}
+	return &ErrorMessage{
+		ErrorType:  "password",
+		StatusCode: http.StatusBadRequest,
+		Message:    "Password does not meet the password policy",
+		Details:    details,
+	}
+}
@@ -0,0 +1,158 @@
+package models
+
+import (
+	rd "crypto/rand"
+	"math/big"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+// The registration modes control how new members can create accounts: open
+// to anyone, only with an invite code, only after an editor's approval, or
+// not at all.
+const (
+	RegistrationOpen     = "open"
+	RegistrationInvite   = "invite"
+	RegistrationApproval = "approval"
+	RegistrationClosed   = "closed"
+)
+
+// RegistrationMode provides the registration mode for the server, and
+// InviteLife how long a new invite code is valid.
+var (
+	RegistrationMode = RegistrationOpen
+	InviteLife       = time.Hour * 24 * 14
+)
+
+// Registration is the self-service request for a new account.
+type Registration struct {
+	Email    string `json:"email" binding:"required"`
+	Password string `json:"password" binding:"required"`
+	First    string `json:"first" binding:"required"`
+	Middle   string `json:"middle"`
+	Last     string `json:"last" binding:"required"`
+	Suffix   string `json:"suffix"`
+	Invite   string `json:"invite"`
+}
+
+// Validate function will check the email address and name fields, trimming
+// the spaces around them.
+func (r *Registration) Validate() *ErrorMessage {
+	r.Email = strings.TrimSpace(r.Email)
+	r.First = strings.TrimSpace(r.First)
+	r.Middle = strings.TrimSpace(r.Middle)
+	r.Last = strings.TrimSpace(r.Last)
+	r.Suffix = strings.TrimSpace(r.Suffix)
+	r.Invite = strings.TrimSpace(r.Invite)
+
+	addr, err := mail.ParseAddress(r.Email)
+	if err != nil || addr.Address != r.Email || len(r.Email) > 254 {
+		return &ErrorMessage{
+			ErrorType:  "registration",
+			StatusCode: http.StatusBadRequest,
+			Message:    "Invalid email address",
+		}
+	}
+	names := []struct{ label, value string }{
+		{"First name", r.First}, {"Middle name", r.Middle},
+		{"Last name", r.Last}, {"Suffix", r.Suffix},
+	}
+	for _, name := range names {
+		if !validName(name.value) {
+			return &ErrorMessage{
+				ErrorType:  "registration",
+				StatusCode: http.StatusBadRequest,
+				Message:    "Invalid " + strings.ToLower(name.label),
+			}
+		}
+	}
+	if r.First == "" || r.Last == "" {
+		return &ErrorMessage{
+			ErrorType:  "registration",
+			StatusCode: http.StatusBadRequest,
+			Message:    "First and last name are required",
+		}
+	}
+	return nil
+}
+
+func validName(name string) bool {
+	if len(name) > 64 {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsMark(r) &&
+			!strings.ContainsRune(" .'-", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewUser function will create the user for the registration, setting the
+// chosen password.  The user must still verify their email address.
+func (r *Registration) NewUser() (*User, *ErrorMessage) {
+	user := User{
+		ID:    uuid.NewString(),
+		Email: r.Email,
+		Name: Name{
+			First:  r.First,
+			Middle: r.Middle,
+			Last:   r.Last,
+			Suffix: r.Suffix,
+		},
+	}
+	user.Name.UserID = user.ID
+	user.Creds.UserID = user.ID
+	if ok, errMsg := user.Creds.SetPassword(r.Password); !ok {
+		return nil, errMsg
+	}
+	user.Creds.PendingApproval = RegistrationMode == RegistrationApproval
+	return &user, nil
+}
+
+// Invite provides a code that allows a new member to register when the
+// server's registration mode requires one.  An invite can be limited to a
+// single email address and can only be used once.
+type Invite struct {
+	Code      string    `json:"code" gorm:"primaryKey;column:code"`
+	Email     string    `json:"email,omitempty" gorm:"column:email"`
+	CreatedBy string    `json:"createdby" gorm:"column:createdby"`
+	Created   time.Time `json:"created" gorm:"column:created"`
+	Expires   time.Time `json:"expires" gorm:"column:expires"`
+	UsedBy    string    `json:"usedby,omitempty" gorm:"column:usedby"`
+	Used      time.Time `json:"used" gorm:"column:used"`
+}
+
+func (Invite) TableName() string {
+	return "user_invites"
+}
+
+// NewInvite function will create an invite with a random code.
+func NewInvite(createdBy string, email string) *Invite {
+	characters := "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	code := ""
+	for i := 0; i < 10; i++ {
+		pos, _ := rd.Int(rd.Reader, big.NewInt(int64(len(characters))))
+		code += characters[pos.Int64() : pos.Int64()+1]
+	}
+	return &Invite{
+		Code:      code,
+		Email:     strings.TrimSpace(email),
+		CreatedBy: createdBy,
+		Created:   time.Now(),
+		Expires:   time.Now().Add(InviteLife),
+	}
+}
+
+// IsValidFor function will report if the invite can still be used by the
+// email address.
+func (i *Invite) IsValidFor(email string) bool {
+	return i.UsedBy == "" && i.Expires.After(time.Now()) &&
+		(i.Email == "" || strings.EqualFold(i.Email, email))
+}
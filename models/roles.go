@@ -0,0 +1,188 @@
+package models
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+
+	"gorm.io/gorm"
+)
+
+// The permissions the API checks.  Roles are granted sets of these, and the
+// routes require them through RequirePermission.
+const (
+	PermStudiesEdit  = "studies.edit"
+	PermUsersView    = "users.view"
+	PermUsersManage  = "users.manage"
+	PermProgressView = "progress.view"
+	PermRolesManage  = "roles.manage"
+)
+
+// The roles created by DefaultRoles.
+const (
+	RoleEditor      = "editor"
+	RoleStudyEditor = "studyeditor"
+	RoleGroupLeader = "leader"
+)
+
+// Permissions provides the description of each permission.
+var Permissions = map[string]string{
+	PermStudiesEdit:  "Create, change and remove the bible study plans",
+	PermUsersView:    "See the user accounts",
+	PermUsersManage:  "Unlock accounts, reset two-factor authentication, end sessions and handle invites and registrations",
+	PermProgressView: "See the members' progress in their bible studies",
+	PermRolesManage:  "Create roles and assign them to users",
+}
+
+// Role is a named set of permissions given to users.
+type Role struct {
+	Name        string           `json:"name" gorm:"primaryKey;column:name"`
+	Description string           `json:"description" gorm:"column:description"`
+	Permissions []RolePermission `json:"permissions" gorm:"foreignKey:RoleName;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+}
+
+func (Role) TableName() string {
+	return "roles"
+}
+
+type RolePermission struct {
+	RoleName   string `json:"-" gorm:"primaryKey;column:role"`
+	Permission string `json:"permission" gorm:"primaryKey;column:permission"`
+}
+
+func (RolePermission) TableName() string {
+	return "role_permissions"
+}
+
+// UserRole gives a role to a user.
+type UserRole struct {
+	UserID   string `json:"-" gorm:"primaryKey;column:userid"`
+	RoleName string `json:"role" gorm:"primaryKey;column:role"`
+}
+
+func (UserRole) TableName() string {
+	return "user_roles"
+}
+
+// DefaultRoles function will provide the roles created when the server
+// starts, if they don't exist.  The editor role has every permission, as
+// the Editor flag it replaces did.
+func DefaultRoles() []Role {
+	all := make([]string, 0)
+	for perm := range Permissions {
+		all = append(all, perm)
+	}
+	sort.Strings(all)
+	return []Role{
+		NewRole(RoleEditor, "Full access to the studies and the user accounts",
+			all...),
+		NewRole(RoleStudyEditor, "Edits the bible study plans",
+			PermStudiesEdit),
+		NewRole(RoleGroupLeader, "Follows the members' progress",
+			PermUsersView, PermProgressView),
+	}
+}
+
+// SetupRoles function will create the default roles that don't exist, then
+// give the editor role to the users with the old Editor flag.  The flag is
+// cleared, so an editor role removed later isn't given back.
+func SetupRoles(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, role := range DefaultRoles() {
+			var count int64
+			err := tx.Model(&Role{}).Where("name = ?", role.Name).
+				Count(&count).Error
+			if err == nil && count == 0 {
+				err = tx.Create(&role).Error
+			}
+			if err != nil {
+				return err
+			}
+		}
+		err := tx.Exec("INSERT INTO user_roles (userid, role) "+
+			"SELECT id, ? FROM users WHERE editor = ? ON CONFLICT DO NOTHING",
+			RoleEditor, true).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&User{}).Where("editor = ?", true).
+			Update("editor", false).Error
+	})
+}
+
+// NewRole function will create the role with the permissions given.
+func NewRole(name string, description string, perms ...string) Role {
+	role := Role{
+		Name:        name,
+		Description: description,
+		Permissions: make([]RolePermission, 0),
+	}
+	role.SetPermissions(perms)
+	return role
+}
+
+// SetPermissions function will replace the role's permissions.
+func (r *Role) SetPermissions(perms []string) {
+	r.Permissions = make([]RolePermission, 0)
+	seen := make(map[string]bool)
+	for _, perm := range perms {
+		if !seen[perm] {
+			seen[perm] = true
+			r.Permissions = append(r.Permissions, RolePermission{
+				RoleName:   r.Name,
+				Permission: perm,
+			})
+		}
+	}
+	sort.Slice(r.Permissions, func(i, j int) bool {
+		return r.Permissions[i].Permission < r.Permissions[j].Permission
+	})
+}
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{1,31}$`)
+
+// Validate function will check the role's name and that its permissions are
+// ones the API knows.
+func (r *Role) Validate() *ErrorMessage {
+	details := make([]string, 0)
+	if !roleNamePattern.MatchString(r.Name) {
+		details = append(details, "Name must be 2 to 32 lower case letters, "+
+			"digits, - or _, starting with a letter")
+	}
+	for _, perm := range r.Permissions {
+		if _, ok := Permissions[perm.Permission]; !ok {
+			details = append(details,
+				fmt.Sprintf("Unknown permission %s", perm.Permission))
+		}
+	}
+	if len(details) == 0 {
+		return nil
+	}
+	return &ErrorMessage{
+		ErrorType:  "role",
+		StatusCode: http.StatusBadRequest,
+		Message:    "Invalid role",
+		Details:    details,
+	}
+}
+
+// RoleNames function will provide the names of the user's roles.
+func (u *User) RoleNames() []string {
+	names := make([]string, 0)
+	for _, role := range u.Roles {
+		names = append(names, role.RoleName)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HasRole function will report if the user has the role.
+func (u *User) HasRole(name string) bool {
+	for _, role := range u.Roles {
+		if role.RoleName == name {
+			return true
+		}
+	}
+	return false
+}
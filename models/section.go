@@ -0,0 +1,196 @@
+package models
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Section is the kind of an entry's text.  The journal follows the SOAP
+// method, so the Scripture, Observation, Application and Prayer sections
+// come first in that order, and any other name is a custom section shown
+// after them.
+type Section string
+
+const (
+	SectionScripture   Section = "scripture"
+	SectionObservation Section = "observation"
+	SectionApplication Section = "application"
+	SectionPrayer      Section = "prayer"
+)
+
+// SOAPSections provides the standard sections in the order they are shown.
+var SOAPSections = []Section{SectionScripture, SectionObservation,
+	SectionApplication, SectionPrayer}
+
+// SectionLimits provides the most characters each standard section may
+// hold, CustomSectionLimit the most for a custom section, and
+// MaxCustomSections how many custom sections an entry may have.
+var (
+	SectionLimits = map[Section]int{
+		SectionScripture:   4000,
+		SectionObservation: 8000,
+		SectionApplication: 8000,
+		SectionPrayer:      8000,
+	}
+	CustomSectionLimit = 4000
+	MaxCustomSections  = 10
+)
+
+// ParseSection function will provide the section for the name given.  The
+// standard sections are matched without regard to case, and may be given by
+// their first letter.  Other names are custom sections, which must be 1 to
+// 40 letters, digits, spaces, - or '.
+func ParseSection(name string) (Section, error) {
+	name = strings.Join(strings.Fields(name), " ")
+	for _, section := range SOAPSections {
+		if strings.EqualFold(name, string(section)) ||
+			strings.EqualFold(name, string(section[:1])) {
+			return section, nil
+		}
+	}
+	if name == "" || utf8.RuneCountInString(name) > 40 {
+		return "", fmt.Errorf("section names must be 1 to 40 characters")
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) &&
+			!strings.ContainsRune(" -'", r) {
+			return "", fmt.Errorf("invalid section name %s", name)
+		}
+	}
+	return Section(name), nil
+}
+
+// IsStandard function will report if the section is one of the SOAP
+// sections.
+func (s Section) IsStandard() bool {
+	_, ok := SectionLimits[s]
+	return ok
+}
+
+// Limit function will provide the most characters the section may hold.
+func (s Section) Limit() int {
+	if limit, ok := SectionLimits[s]; ok {
+		return limit
+	}
+	return CustomSectionLimit
+}
+
+// rank function will provide the section's place in the entry, with the
+// custom sections after the standard sections.
+func (s Section) rank() int {
+	for i, section := range SOAPSections {
+		if s == section {
+			return i
+		}
+	}
+	return len(SOAPSections)
+}
+
+// checkSections function will check the texts' sections and lengths, making
+// the section names standard.
+func checkSections(texts []EntryText) []string {
+	details := make([]string, 0)
+	seen := make(map[Section]bool)
+	custom := 0
+	for i := range texts {
+		section, err := ParseSection(string(texts[i].TextType))
+		if err != nil {
+			details = append(details, err.Error())
+			continue
+		}
+		texts[i].TextType = section
+		if seen[section] {
+			details = append(details, fmt.Sprintf("Section %s is given twice",
+				section))
+		}
+		seen[section] = true
+		if !section.IsStandard() {
+			custom++
+		}
+		if utf8.RuneCountInString(texts[i].EntryText) > section.Limit() {
+			details = append(details, fmt.Sprintf(
+				"Section %s must be at most %d characters", section,
+				section.Limit()))
+		}
+	}
+	if custom > MaxCustomSections {
+		details = append(details, fmt.Sprintf(
+			"An entry can have at most %d custom sections", MaxCustomSections))
+	}
+	return details
+}
+
+// ByEntryText sorts an entry's texts in the order they are shown: the SOAP
+// sections, then the custom sections in the order they were given.
+type ByEntryText []EntryText
+
+func (s ByEntryText) Len() int      { return len(s) }
+func (s ByEntryText) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s ByEntryText) Less(i, j int) bool {
+	if s[i].TextType.rank() != s[j].TextType.rank() {
+		return s[i].TextType.rank() < s[j].TextType.rank()
+	}
+	return s[i].Position < s[j].Position
+}
+
+// EntryDocument is a decrypted entry laid out by its SOAP sections, with the
+// custom sections after them.
+type EntryDocument struct {
+	ID          string           `json:"id"`
+	EntryDate   string           `json:"entrydate"`
+	Title       string           `json:"title"`
+	Reference   []EntryReference `json:"reference"`
+	Scripture   string           `json:"scripture"`
+	Observation string           `json:"observation"`
+	Application string           `json:"application"`
+	Prayer      string           `json:"prayer"`
+	Extra       []EntrySection   `json:"extra"`
+}
+
+type EntrySection struct {
+	Section Section `json:"section"`
+	Text    string  `json:"text"`
+}
+
+// Document function will lay out the decrypted entry by its sections.
+func (e *Entry) Document() (*EntryDocument, *ErrorMessage) {
+	doc := &EntryDocument{
+		ID:        e.ID,
+		EntryDate: e.EntryDate.Format("2006-01-02"),
+		Title:     e.Title,
+		Reference: e.Reference,
+		Extra:     make([]EntrySection, 0),
+	}
+	standard := map[Section]*string{
+		SectionScripture:   &doc.Scripture,
+		SectionObservation: &doc.Observation,
+		SectionApplication: &doc.Application,
+		SectionPrayer:      &doc.Prayer,
+	}
+	e.SortTexts()
+	for _, txt := range e.Texts {
+		if txt.Encrypted {
+			return nil, &ErrorMessage{
+				ErrorType:  "entry",
+				StatusCode: http.StatusInternalServerError,
+				Message:    "entry isn't decrypted",
+			}
+		}
+		section, err := ParseSection(string(txt.TextType))
+		if err != nil {
+			section = txt.TextType
+		}
+		if field, ok := standard[section]; ok {
+			*field = txt.EntryText
+		} else {
+			doc.Extra = append(doc.Extra, EntrySection{
+				Section: section,
+				Text:    txt.EntryText,
+			})
+		}
+	}
+	return doc, nil
+}
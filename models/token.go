@@ -1,12 +1,41 @@
 package models
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
 	"time"
+
+	"github.com/google/uuid"
+)
+
+// AccessTokenLife and RefreshTokenLife provide how long the tokens issued at
+// log in are valid.  An access token is renewed with its refresh token, so
+// only the refresh token's life requires the user to log in again.
+// TokenIssuer and TokenAudience are given in the access tokens' iss and aud
+// claims, and a token must have both to be accepted.
+var (
+	AccessTokenLife  = time.Minute * 30
+	RefreshTokenLife = time.Hour * 24 * 30
+	TokenIssuer      = "go-soap"
+	TokenAudience    = "go-soap"
 )
 
+// Token records each access token issued, with the user and device it was
+// issued to.  Removing the row revokes the access token.
 type Token struct {
-	ID      string    `json:"id" gorm:"primaryKey;column:id"`
-	Expires time.Time `json:"-" gorm:"column:expires"`
+	ID        string    `json:"id" gorm:"primaryKey;column:id"`
+	UserID    string    `json:"-" gorm:"column:userid;index"`
+	FamilyID  string    `json:"-" gorm:"column:familyid"`
+	RemoteIP  string    `json:"remote_ip" gorm:"column:remote_ip"`
+	UserAgent string    `json:"user_agent" gorm:"column:user_agent"`
+	Issued    time.Time `json:"issued" gorm:"column:issued"`
+	Expires   time.Time `json:"-" gorm:"column:expires"`
 }
 
 func (Token) TableName() string {
@@ -20,3 +49,118 @@ type ByToken []Token
 func (s ByToken) Len() int           { return len(s) }
 func (s ByToken) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 func (s ByToken) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+// Session provides the view of a refresh family given to the user, so the
+// user can see where they are logged in.  The remote address and user agent
+// are from the latest access token issued in the family.
+type Session struct {
+	ID        string    `json:"id"`
+	RemoteIP  string    `json:"remote_ip"`
+	UserAgent string    `json:"user_agent"`
+	Issued    time.Time `json:"issued"`
+	Expires   time.Time `json:"expires"`
+	Current   bool      `json:"current"`
+}
+
+// BySession will provide the sort interface methods for sorting sessions with
+// the latest used first.
+type BySession []Session
+
+func (s BySession) Len() int           { return len(s) }
+func (s BySession) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s BySession) Less(i, j int) bool { return s[i].Issued.After(s[j].Issued) }
+
+// BuildSessions function will create a session for each of the active refresh
+// tokens, marking the one in the current family.
+func BuildSessions(tokens []Token, refresh []RefreshToken,
+	current string) []Session {
+	latest := make(map[string]Token)
+	for _, t := range tokens {
+		if prev, ok := latest[t.FamilyID]; !ok || t.Issued.After(prev.Issued) {
+			latest[t.FamilyID] = t
+		}
+	}
+	sessions := make([]Session, 0)
+	for _, rt := range refresh {
+		if rt.Used || rt.Revoked || rt.Expires.Before(time.Now()) {
+			continue
+		}
+		session := Session{
+			ID:      rt.FamilyID,
+			Issued:  rt.Issued,
+			Expires: rt.Expires,
+			Current: rt.FamilyID == current,
+		}
+		if t, ok := latest[rt.FamilyID]; ok {
+			session.RemoteIP = t.RemoteIP
+			session.UserAgent = t.UserAgent
+		}
+		sessions = append(sessions, session)
+	}
+	sort.Sort(BySession(sessions))
+	return sessions
+}
+
+// RefreshToken is a long-lived, single use token that allows the user to get
+// a new access token without logging in.  Each use replaces the refresh
+// token with a new one in the same family, and any reuse of a replaced token
+// will revoke the whole family.  Only a hash of the token's secret is stored.
+type RefreshToken struct {
+	ID       string    `json:"id" gorm:"primaryKey;column:id"`
+	UserID   string    `json:"-" gorm:"column:userid;index"`
+	FamilyID string    `json:"-" gorm:"column:familyid;index"`
+	Secret   string    `json:"-" gorm:"column:secret"`
+	Issued   time.Time `json:"issued" gorm:"column:issued"`
+	Expires  time.Time `json:"expires" gorm:"column:expires"`
+	Used     bool      `json:"-" gorm:"column:used"`
+	Revoked  bool      `json:"-" gorm:"column:revoked"`
+}
+
+func (RefreshToken) TableName() string {
+	return "user_refresh_tokens"
+}
+
+// NewRefreshToken function will create a refresh token for the user in the
+// given family, or in a new family if none is given.  The encoded token
+// returned is the value given to the client, it is not stored.
+func NewRefreshToken(userID string, family string) (*RefreshToken, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	if family == "" {
+		family = uuid.NewString()
+	}
+	encodedSecret := base64.RawURLEncoding.EncodeToString(secret)
+	rt := &RefreshToken{
+		ID:       uuid.NewString(),
+		UserID:   userID,
+		FamilyID: family,
+		Secret:   hashSecret(encodedSecret),
+		Issued:   time.Now(),
+		Expires:  time.Now().Add(RefreshTokenLife),
+	}
+	return rt, rt.ID + "." + encodedSecret, nil
+}
+
+// ParseRefreshToken function will separate the encoded token given to the
+// client into the token's identifier and secret.
+func ParseRefreshToken(encoded string) (string, string, error) {
+	parts := strings.SplitN(encoded, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New("invalid refresh token")
+	}
+	return parts[0], parts[1], nil
+}
+
+// Matches function will compare the secret with the stored hash in constant
+// time.
+func (rt *RefreshToken) Matches(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(rt.Secret),
+		[]byte(hashSecret(secret))) == 1
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,244 @@
+package models
+
+import (
+	"crypto/hmac"
+	rd "crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The TOTP settings follow RFC 6238's defaults, which every authenticator app
+// supports: HMAC-SHA1, six digits and a thirty second step.  A code from the
+// step before or after the current one is accepted for clock drift.
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	totpWindow = 1
+)
+
+// TOTPIssuer provides the name shown for the account in authenticator apps,
+// and RequireEditorTOTP if users with roles must use two-factor
+// authentication for the functions their roles allow.
+var (
+	TOTPIssuer        = "SOAP Journal"
+	RequireEditorTOTP = false
+)
+
+// TOTPRecoveryCode is a single use code that can be used in place of a TOTP
+// code when the user doesn't have their authenticator.  Only a hash of the
+// code is stored.
+type TOTPRecoveryCode struct {
+	ID                uint64 `json:"-" gorm:"primaryKey;column:id;autoIncrement"`
+	CredentialsUserID string `json:"-" gorm:"column:userid;index"`
+	Hash              string `json:"-" gorm:"column:hash"`
+	Used              bool   `json:"-" gorm:"column:used"`
+}
+
+func (TOTPRecoveryCode) TableName() string {
+	return "user_totp_recovery"
+}
+
+// totpCode function will compute the code for the secret at the time step,
+// as given by RFC 4226 and RFC 6238.
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).
+		DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// StartTOTP function will start the two-factor enrollment by creating a new
+// secret.  Two-factor authentication isn't enabled until the user confirms
+// a code from their authenticator.
+func (c *Credentials) StartTOTP() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rd.Read(secret); err != nil {
+		return "", err
+	}
+	c.TOTPSecret = base32.StdEncoding.WithPadding(base32.NoPadding).
+		EncodeToString(secret)
+	c.TOTPEnabled = false
+	c.TOTPLastStep = 0
+	return c.TOTPSecret, nil
+}
+
+// TOTPURI function will provide the otpauth provisioning URI for the secret,
+// which is shown to the user as a QR code for their authenticator to scan.
+func TOTPURI(secret string, email string) string {
+	label := url.PathEscape(TOTPIssuer + ":" + email)
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", TOTPIssuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(totpDigits))
+	values.Set("period", fmt.Sprint(totpPeriod))
+	// authenticators expect spaces as %20, not the + used in query strings.
+	query := strings.ReplaceAll(values.Encode(), "+", "%20")
+	return "otpauth://totp/" + label + "?" + query
+}
+
+// CheckTOTP function will check the code against the secret.  Each time step
+// can only be used once, so a code seen by someone else can't be replayed.
+func (c *Credentials) CheckTOTP(code string) bool {
+	if c.TOTPSecret == "" {
+		return false
+	}
+	code = strings.ReplaceAll(code, " ", "")
+	current := time.Now().Unix() / totpPeriod
+	for step := current - totpWindow; step <= current+totpWindow; step++ {
+		if step <= c.TOTPLastStep {
+			continue
+		}
+		expected, err := totpCode(c.TOTPSecret, step)
+		if err != nil {
+			return false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			c.TOTPLastStep = step
+			return true
+		}
+	}
+	return false
+}
+
+// EnableTOTP function will complete the two-factor enrollment once the user
+// confirms a code from their authenticator.  A wrong code counts as a bad
+// attempt.
+func (c *Credentials) EnableTOTP(code string) (bool, *ErrorMessage) {
+	if c.TOTPEnabled {
+		return false, invalidTOTPError()
+	}
+	if ok, errMsg := c.CheckTOTPAttempt(code); !ok {
+		return false, errMsg
+	}
+	c.TOTPEnabled = true
+	return true, nil
+}
+
+// CheckTOTPAttempt function will check a code from the user's authenticator
+// given to change their two-factor settings.  A wrong code counts as a bad
+// attempt, as at log in, so enough of them lock the account.
+func (c *Credentials) CheckTOTPAttempt(code string) (bool, *ErrorMessage) {
+	if c.IsLocked() {
+		return false, c.lockedError()
+	}
+	if c.CheckTOTP(code) {
+		c.BadAttempts = 0
+		return true, nil
+	}
+	if c.recordFailure() {
+		return false, c.lockedError()
+	}
+	return false, invalidTOTPError()
+}
+
+func invalidTOTPError() *ErrorMessage {
+	return &ErrorMessage{
+		ErrorType:  "two factor",
+		StatusCode: http.StatusUnauthorized,
+		Message:    "Invalid Two-Factor Code",
+	}
+}
+
+// DisableTOTP function will remove the user's two-factor authentication and
+// recovery codes.
+func (c *Credentials) DisableTOTP() {
+	c.TOTPEnabled = false
+	c.TOTPSecret = ""
+	c.TOTPLastStep = 0
+	c.RecoveryCodes = nil
+}
+
+// NewRecoveryCodes function will replace the user's recovery codes with ten
+// new ones, returning the codes to show the user once.
+func (c *Credentials) NewRecoveryCodes() ([]string, error) {
+	codes := make([]string, 0)
+	c.RecoveryCodes = make([]TOTPRecoveryCode, 0)
+	for i := 0; i < 10; i++ {
+		raw := make([]byte, 5)
+		if _, err := rd.Read(raw); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(raw))
+		code = code[:4] + "-" + code[4:]
+		codes = append(codes, code)
+		c.RecoveryCodes = append(c.RecoveryCodes, TOTPRecoveryCode{
+			CredentialsUserID: c.UserID,
+			Hash:              hashSecret(normalizeRecoveryCode(code)),
+		})
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.ReplaceAll(code, "-", "")
+}
+
+// useRecoveryCode function will mark the matching unused recovery code as
+// used, returning nil if none match.
+func (c *Credentials) useRecoveryCode(code string) *TOTPRecoveryCode {
+	hash := hashSecret(normalizeRecoveryCode(code))
+	for i := range c.RecoveryCodes {
+		rc := &c.RecoveryCodes[i]
+		if !rc.Used &&
+			subtle.ConstantTimeCompare([]byte(rc.Hash), []byte(hash)) == 1 {
+			rc.Used = true
+			return rc
+		}
+	}
+	return nil
+}
+
+// VerifySecondFactor function will check the TOTP or recovery code given at
+// log in, when the user has two-factor authentication enabled.  A wrong code
+// counts as a bad attempt, and no code is accepted while the account is
+// locked.  A good code completes the log in, so the count starts again.  The
+// recovery code used, if any, is returned so it can be saved.
+func (c *Credentials) VerifySecondFactor(code string) (bool, *TOTPRecoveryCode,
+	*ErrorMessage) {
+	if !c.TOTPEnabled {
+		return true, nil, nil
+	}
+	if c.IsLocked() {
+		return false, nil, c.lockedError()
+	}
+	if code == "" {
+		return false, nil, &ErrorMessage{
+			ErrorType:  "two factor",
+			StatusCode: http.StatusUnauthorized,
+			Message:    "Two-Factor Code Required",
+		}
+	}
+	ok := c.CheckTOTP(code)
+	var rc *TOTPRecoveryCode
+	if !ok {
+		rc = c.useRecoveryCode(code)
+		ok = rc != nil
+	}
+	if ok {
+		c.BadAttempts = 0
+		c.LockCount = 0
+		return true, rc, nil
+	}
+	if c.recordFailure() {
+		return false, nil, c.lockedError()
+	}
+	return false, nil, invalidTOTPError()
+}
@@ -2,38 +2,130 @@ package models
 
 import (
 	rd "crypto/rand"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"math/big"
-	"math/rand"
 	"net/http"
-	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
-	"github.com/joho/godotenv"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
+// RemoteTokenLife provides how long a new remote approval code is valid,
+// VerificationTokenLife how long an email verification code is valid,
+// VerificationResendWait how long a user must wait to have another email
+// verification code sent, and ResetTokenLife and ResetResendWait the same
+// for the reset password code.
+var (
+	RemoteTokenLife        = time.Minute * 15
+	VerificationTokenLife  = time.Hour * 24
+	VerificationResendWait = time.Minute * 5
+	ResetTokenLife         = time.Hour
+	ResetResendWait        = time.Minute * 5
+)
+
+// User is a member of the journal.  Editor is the flag used before roles
+// were added, which is moved to the editor role when the server starts.  A
+// removed user is only marked as deleted, so the user's studies and the
+// audit log still refer to an account.
 type User struct {
 	ID      string           `json:"id" gorm:"primaryKey;column:id"`
 	Email   string           `json:"email" gorm:"column:email"`
-	Editor  bool             `json:"editor,omitempty" gorm:"column:editor"`
+	Editor  bool             `json:"-" gorm:"column:editor"`
 	Name    Name             `json:"name" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
 	Creds   Credentials      `json:"creds,omitempty" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	Roles   []UserRole       `json:"roles" gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
 	Studies []UserBibleStudy `json:"studies" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	Deleted gorm.DeletedAt   `json:"-" gorm:"column:deleted;index"`
 }
 
 func (User) TableName() string {
 	return "users"
 }
 
+// AccountUpdate is an editor's change to a user's email address and name.
+type AccountUpdate struct {
+	Email  string `json:"email" binding:"required"`
+	First  string `json:"first" binding:"required"`
+	Middle string `json:"middle"`
+	Last   string `json:"last" binding:"required"`
+	Suffix string `json:"suffix"`
+}
+
+// Validate function will check the email address and name fields like a
+// registration's, trimming the spaces around them.
+func (a *AccountUpdate) Validate() *ErrorMessage {
+	reg := Registration{
+		Email:  a.Email,
+		First:  a.First,
+		Middle: a.Middle,
+		Last:   a.Last,
+		Suffix: a.Suffix,
+	}
+	if errMsg := reg.Validate(); errMsg != nil {
+		errMsg.ErrorType = "user"
+		return errMsg
+	}
+	a.Email, a.First, a.Middle = reg.Email, reg.First, reg.Middle
+	a.Last, a.Suffix = reg.Last, reg.Suffix
+	return nil
+}
+
+// Apply function will make the change to the user, providing a description
+// of the fields changed for the audit log.
+func (a *AccountUpdate) Apply(u *User) string {
+	changes := make([]string, 0)
+	fields := []struct {
+		label  string
+		target *string
+		value  string
+	}{
+		{"email", &u.Email, a.Email}, {"first", &u.Name.First, a.First},
+		{"middle", &u.Name.Middle, a.Middle}, {"last", &u.Name.Last, a.Last},
+		{"suffix", &u.Name.Suffix, a.Suffix},
+	}
+	for _, field := range fields {
+		if *field.target != field.value {
+			changes = append(changes, fmt.Sprintf("%s: %q to %q", field.label,
+				*field.target, field.value))
+			*field.target = field.value
+		}
+	}
+	return strings.Join(changes, ", ")
+}
+
+// VerifyRemoteToken function will check the code sent to approve a new remote
+// address.  The code must be used before it expires and from the remote
+// address it was issued for, and each failure counts as a bad attempt.  For
+// users with two-factor authentication the count starts again once their code
+// is checked too.
 func (u *User) VerifyRemoteToken(token string, ipaddr string) (bool, *ErrorMessage) {
-	if u.Creds.NewRemoteToken == token {
+	c := &u.Creds
+	if c.IsLocked() {
+		return false, c.lockedError()
+	}
+	if c.NewRemoteToken != "" && c.NewRemoteIP == ipaddr &&
+		c.NewRemoteExpires.After(time.Now()) &&
+		subtle.ConstantTimeCompare([]byte(c.NewRemoteToken), []byte(token)) == 1 {
+		c.NewRemoteToken = ""
+		c.NewRemoteIP = ""
+		c.NewRemoteExpires = time.Time{}
+		if !c.TOTPEnabled {
+			c.BadAttempts = 0
+			c.LockCount = 0
+		}
 		return true, nil
 	}
+	if c.recordFailure() {
+		c.NewRemoteToken = ""
+	}
 	return false, &ErrorMessage{
 		ErrorType:  "new remote",
 		StatusCode: http.StatusUnauthorized,
@@ -42,15 +134,45 @@ func (u *User) VerifyRemoteToken(token string, ipaddr string) (bool, *ErrorMessa
 }
 
 type UserRemote struct {
-	ID                uint64 `json:"id" gorm:"primaryKey;column:id;autoIncrement"`
-	CredentialsUserID string `json:"-" gorm:"column:userid"`
-	RemoteIP          string `json:"remote_ip" gorm:"column:remote_ip"`
+	ID                uint64    `json:"id" gorm:"primaryKey;column:id;autoIncrement"`
+	CredentialsUserID string    `json:"-" gorm:"column:userid"`
+	RemoteIP          string    `json:"remote_ip" gorm:"column:remote_ip"`
+	Label             string    `json:"label" gorm:"column:label"`
+	UserAgent         string    `json:"user_agent" gorm:"column:user_agent"`
+	Created           time.Time `json:"created" gorm:"column:created"`
+	LastSeen          time.Time `json:"lastseen" gorm:"column:lastseen"`
 }
 
 func (UserRemote) TableName() string {
 	return "user_remotes"
 }
 
+// DeviceLabel function will provide a friendly name for a device from its
+// browser's user agent, like "Firefox on Windows".
+func DeviceLabel(userAgent string) string {
+	browsers := []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"}, {"Safari/", "Safari"}, {"curl/", "curl"},
+	}
+	systems := []struct{ token, name string }{
+		{"Android", "Android"}, {"iPhone", "iPhone"}, {"iPad", "iPad"},
+		{"Windows", "Windows"}, {"Mac OS X", "Mac"}, {"Linux", "Linux"},
+	}
+	browser := "Unknown Browser"
+	for _, b := range browsers {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, s := range systems {
+		if strings.Contains(userAgent, s.token) {
+			return fmt.Sprintf("%s on %s", browser, s.name)
+		}
+	}
+	return browser
+}
+
 type Name struct {
 	UserID string `json:"-" gorm:"primaryKey;column:userid"`
 	First  string `json:"first" gorm:"column:first"`
@@ -73,19 +195,40 @@ func (n *Name) FullName() string {
 }
 
 type Credentials struct {
-	UserID            string       `json:"-" gorm:"primaryKey;column:userid"`
-	Password          string       `json:"-" gorm:"column:password"`
-	Expires           time.Time    `json:"expires" gorm:"column:expires"`
-	MustChange        bool         `json:"mustchange" gorm:"column:mustchange"`
-	Locked            bool         `json:"locked" gorm:"column:locked"`
-	BadAttempts       int16        `json:"-" gorm:"column:badattempts"`
-	Verified          time.Time    `json:"-" gorm:"column:verified"`
-	VerificationToken string       `json:"-" gorm:"column:verificationtoken"`
-	ResetToken        string       `json:"-" gorm:"column:resettoken"`
-	ResetExpires      time.Time    `json:"-" gorm:"column:resetexpires"`
-	NewRemoteToken    string       `json:"-" gorm:"column:newremotetoken"`
-	Remotes           []UserRemote `json:"remotes" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
-	PrivateKey        string       `json:"-" gorm:"column:privatekey"`
+	UserID               string               `json:"-" gorm:"primaryKey;column:userid"`
+	Password             string               `json:"-" gorm:"column:password"`
+	Expires              time.Time            `json:"expires" gorm:"column:expires"`
+	MustChange           bool                 `json:"mustchange" gorm:"column:mustchange"`
+	Locked               bool                 `json:"locked" gorm:"column:locked"`
+	BadAttempts          int16                `json:"-" gorm:"column:badattempts"`
+	LockedUntil          time.Time            `json:"lockeduntil" gorm:"column:lockeduntil"`
+	LockCount            int16                `json:"-" gorm:"column:lockcount"`
+	Verified             time.Time            `json:"-" gorm:"column:verified"`
+	VerificationToken    string               `json:"-" gorm:"column:verificationtoken"`
+	VerificationSent     time.Time            `json:"-" gorm:"column:verificationsent"`
+	VerificationExpires  time.Time            `json:"-" gorm:"column:verificationexpires"`
+	VerificationAttempts int16                `json:"-" gorm:"column:verificationattempts"`
+	ResetToken           string               `json:"-" gorm:"column:resettoken"`
+	ResetExpires         time.Time            `json:"-" gorm:"column:resetexpires"`
+	ResetAttempts        int16                `json:"-" gorm:"column:resetattempts"`
+	NewRemoteToken       string               `json:"-" gorm:"column:newremotetoken"`
+	NewRemoteIP          string               `json:"-" gorm:"column:newremoteip"`
+	NewRemoteExpires     time.Time            `json:"-" gorm:"column:newremoteexpires"`
+	PendingApproval      bool                 `json:"pending" gorm:"column:pending"`
+	Remotes              []UserRemote         `json:"remotes" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	History              []PasswordHistory    `json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	PrivateKey           string               `json:"-" gorm:"column:privatekey"`
+	JournalKey           string               `json:"-" gorm:"column:journalkey"`
+	JournalSalt          string               `json:"-" gorm:"column:journalsalt"`
+	JournalKDF           string               `json:"-" gorm:"column:journalkdf"`
+	JournalKeyID         string               `json:"-" gorm:"column:journalkeyid"`
+	JournalRecovery      string               `json:"-" gorm:"column:journalrecovery"`
+	TOTPSecret           string               `json:"-" gorm:"column:totpsecret"`
+	TOTPEnabled          bool                 `json:"twofactor" gorm:"column:totpenabled"`
+	TOTPLastStep         int64                `json:"-" gorm:"column:totplaststep"`
+	RecoveryCodes        []TOTPRecoveryCode   `json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	Passkeys             []WebAuthnCredential `json:"passkeys" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	OIDCLinks            []OIDCLink           `json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
 }
 
 func (Credentials) TableName() string {
@@ -93,10 +236,114 @@ func (Credentials) TableName() string {
 }
 
 // SetPassword function will reset the password to a new value, storing the
-// new password in the database
+// new password in the database.  The password must meet the password policy
+// and not be one of the user's previous passwords, and the replaced password
+// is added to the user's password history.
 func (c *Credentials) SetPassword(passwd string) (bool, *ErrorMessage) {
-	cost := rand.Intn(3) + 10
-	bytes, err := bcrypt.GenerateFromPassword([]byte(passwd), cost)
+	failures := Passwords.Check(passwd)
+	sort.Sort(ByPasswordHistory(c.History))
+	if c.usedBefore(passwd) {
+		failures = append(failures, "must not be one of your previous passwords")
+	}
+	if len(failures) > 0 {
+		return false, policyError(failures)
+	}
+	previous := c.Password
+	if ok, errMsg := c.setHash(passwd); !ok {
+		return false, errMsg
+	}
+	if previous != "" && Passwords.History > 1 {
+		c.History = append([]PasswordHistory{{
+			CredentialsUserID: c.UserID,
+			Hash:              previous,
+			Created:           time.Now(),
+		}}, c.History...)
+		if len(c.History) > Passwords.History-1 {
+			c.History = c.History[:Passwords.History-1]
+		}
+	}
+	c.MustChange = false
+	return true, nil
+}
+
+// SetTemporaryPassword function will set a password given to the user by the
+// system, like the initial password, without checking the password policy.
+// The user must change the password at their next log in.
+func (c *Credentials) SetTemporaryPassword(passwd string) (bool, *ErrorMessage) {
+	if ok, errMsg := c.setHash(passwd); !ok {
+		return false, errMsg
+	}
+	c.MustChange = true
+	return true, nil
+}
+
+// Reauthenticate function will check the current password or a TOTP code
+// the signed in user gave before a sensitive change, like adding a passkey.
+// A wrong password or code counts as a bad attempt, as at log in.
+func (c *Credentials) Reauthenticate(passwd string,
+	code string) (bool, *ErrorMessage) {
+	if c.IsLocked() {
+		return false, c.lockedError()
+	}
+	if passwd == "" && code == "" {
+		return false, &ErrorMessage{
+			ErrorType:  "credentials",
+			StatusCode: http.StatusUnauthorized,
+			Message:    "Password or Two-Factor Code Required",
+		}
+	}
+	if (passwd != "" && c.CheckPassword(passwd)) ||
+		(code != "" && c.TOTPEnabled && c.CheckTOTP(code)) {
+		c.BadAttempts = 0
+		return true, nil
+	}
+	if c.recordFailure() {
+		return false, c.lockedError()
+	}
+	return false, &ErrorMessage{
+		ErrorType:  "credentials",
+		StatusCode: http.StatusUnauthorized,
+		Message:    "Password or Two-Factor Code is incorrect",
+	}
+}
+
+// CheckPasswordAttempt function will check the current password the signed
+// in user gave before a change to their account.  A wrong password counts as
+// a bad attempt, as at log in, so enough of them lock the account.
+func (c *Credentials) CheckPasswordAttempt(passwd string) (bool, *ErrorMessage) {
+	if c.IsLocked() {
+		return false, c.lockedError()
+	}
+	if c.CheckPassword(passwd) {
+		c.BadAttempts = 0
+		return true, nil
+	}
+	if c.recordFailure() {
+		return false, c.lockedError()
+	}
+	return false, &ErrorMessage{
+		ErrorType:  "password",
+		StatusCode: http.StatusUnauthorized,
+		Message:    "Password is incorrect",
+	}
+}
+
+// HasPassword function will report if the user has set a password, which
+// users created by the identity provider don't have until they use the
+// forgot password process.
+func (c *Credentials) HasPassword() bool {
+	return c.Password != ""
+}
+
+// CheckPassword function will report if the password matches the stored
+// password.
+func (c *Credentials) CheckPassword(passwd string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(c.Password),
+		[]byte(passwd)) == nil
+}
+
+func (c *Credentials) setHash(passwd string) (bool, *ErrorMessage) {
+	bytes, err := bcrypt.GenerateFromPassword([]byte(passwd), Passwords.Cost)
 	if err != nil {
 		errMsg := ErrorMessage{
 			ErrorType:  "password",
@@ -104,22 +351,19 @@ func (c *Credentials) SetPassword(passwd string) (bool, *ErrorMessage) {
 			Message:    err.Error(),
 		}
 		return false, &errMsg
-	} else {
-		c.Password = string(bytes)
-		c.Expires = time.Now().Add(time.Hour * 24 * 90)
-		c.MustChange = false
-		c.BadAttempts = 0
-		c.Locked = false
-		return true, nil
 	}
+	c.Password = string(bytes)
+	c.Expires = time.Now().Add(time.Hour * 24 * 90)
+	c.BadAttempts = 0
+	c.Locked = false
+	return true, nil
 }
 
 // LogIn function will be used to check the password will match the stored
 // password, but the employee's email must be verified, if not reject at the
 // start, if verified, compare password, then check badAttempts and expiration.
 func (c *Credentials) LogIn(passwd string, remote string) (bool, *ErrorMessage) {
-	if c.Verified.Before(time.Date(1970, time.January, 2, 0,
-		0, 0, 0, time.UTC)) {
+	if !c.IsVerified() {
 		errMsg := ErrorMessage{
 			ErrorType:  "credentials",
 			StatusCode: 401,
@@ -127,6 +371,9 @@ func (c *Credentials) LogIn(passwd string, remote string) (bool, *ErrorMessage)
 		}
 		return false, &errMsg
 	}
+	if c.IsLocked() {
+		return false, c.lockedError()
+	}
 	err := bcrypt.CompareHashAndPassword([]byte(c.Password), []byte(passwd))
 	if err != nil {
 		errMsg := ErrorMessage{
@@ -134,27 +381,25 @@ func (c *Credentials) LogIn(passwd string, remote string) (bool, *ErrorMessage)
 			StatusCode: 401,
 			Message:    err.Error(),
 		}
-		c.BadAttempts++
-		if c.BadAttempts > 2 {
-			c.Locked = true
+		if c.recordFailure() {
+			return false, c.lockedError()
 		}
 		return false, &errMsg
 	}
-	if c.Expires.Before(time.Now()) {
+	if c.PendingApproval {
 		errMsg := ErrorMessage{
 			ErrorType:  "credentials",
 			StatusCode: 401,
-			Message:    "Account Expired",
+			Message:    "Account Pending Approval",
 		}
 		return false, &errMsg
 	}
-	if c.BadAttempts > 2 {
+	if c.Expires.Before(time.Now()) {
 		errMsg := ErrorMessage{
 			ErrorType:  "credentials",
 			StatusCode: 401,
-			Message:    "Account Locked",
+			Message:    "Account Expired",
 		}
-		c.Locked = true
 		return false, &errMsg
 	}
 	if !c.HasRemote(remote) {
@@ -165,28 +410,72 @@ func (c *Credentials) LogIn(passwd string, remote string) (bool, *ErrorMessage)
 		}
 		return true, &errMsg
 	}
-	c.BadAttempts = 0
-	c.Locked = false
+	// with two-factor authentication the count starts again only once the
+	// code is given too, so the code can't be guessed between passwords.
+	if !c.TOTPEnabled {
+		c.BadAttempts = 0
+		c.LockCount = 0
+	}
 	return true, nil
 }
 
+// lockedError function will provide the error message for a locked account,
+// with the time the lock ends if it has one.
+func (c *Credentials) lockedError() *ErrorMessage {
+	message := "Account Locked"
+	if !c.LockedUntil.IsZero() {
+		message += " until " + c.LockedUntil.Format(time.RFC3339)
+	}
+	return &ErrorMessage{
+		ErrorType:  "credentials",
+		StatusCode: 401,
+		Message:    message,
+	}
+}
+
 // StartVerification function will start the Email Verification process, by
-// creating a random token.
+// creating a random token that expires after VerificationTokenLife.
 func (c *Credentials) StartVerification() string {
 	c.Verified = time.Date(1970, time.January, 1, 0, 0, 0, 0, time.UTC)
 	c.VerificationToken = c.randomToken(8)
+	c.VerificationSent = time.Now()
+	c.VerificationExpires = c.VerificationSent.Add(VerificationTokenLife)
+	c.VerificationAttempts = 0
 	return c.VerificationToken
 }
 
+// IsVerified function will report if the Email Verification process has been
+// completed.
+func (c *Credentials) IsVerified() bool {
+	return !c.Verified.Before(time.Date(1970, time.January, 2, 0, 0, 0, 0,
+		time.UTC))
+}
+
+// CanResendVerification function will report if enough time has passed since
+// the last verification token was sent to send another.
+func (c *Credentials) CanResendVerification() bool {
+	return time.Since(c.VerificationSent) >= VerificationResendWait
+}
+
 // Verify function will be used to complete the Email Verification process, by
-// removing the verification token and setting the verification datetime.
+// removing the verification token and setting the verification datetime.  The
+// token is removed after three failures, so a new one must be sent.
 func (c *Credentials) Verify(token string) (bool, *ErrorMessage) {
-	fmt.Printf("DB Token: %s - Passed Token: %s\n", c.VerificationToken, token)
-	if c.VerificationToken == token {
+	if c.VerificationToken != "" &&
+		c.VerificationExpires.After(time.Now()) &&
+		subtle.ConstantTimeCompare([]byte(c.VerificationToken),
+			[]byte(token)) == 1 {
 		c.Verified = time.Now()
 		c.VerificationToken = ""
+		c.VerificationExpires = time.Time{}
+		c.VerificationAttempts = 0
 		return true, nil
 	}
+	c.VerificationAttempts++
+	if c.VerificationAttempts > 2 {
+		c.VerificationToken = ""
+		c.VerificationExpires = time.Time{}
+	}
 	return false, &ErrorMessage{
 		ErrorType:  "verification",
 		StatusCode: 401,
@@ -194,10 +483,13 @@ func (c *Credentials) Verify(token string) (bool, *ErrorMessage) {
 	}
 }
 
-// New Remote start will create a token for allowing the user to approve a new
-// computer or other device to be used.
-func (c *Credentials) StartRemoteToken() string {
+// StartRemoteToken function will create a token for allowing the user to
+// approve a new computer or other device to be used.  The token is only good
+// for the remote address given and for RemoteTokenLife.
+func (c *Credentials) StartRemoteToken(ipaddress string) string {
 	c.NewRemoteToken = c.randomToken(7)
+	c.NewRemoteIP = ipaddress
+	c.NewRemoteExpires = time.Now().Add(RemoteTokenLife)
 	return c.NewRemoteToken
 }
 
@@ -211,14 +503,95 @@ func (c *Credentials) HasRemote(ipaddress string) bool {
 	return answer
 }
 
+// AddRemote function will add an approved remote address to the user's
+// credentials, labeled from the user agent if no label is given.
+func (c *Credentials) AddRemote(ipaddress string, label string,
+	userAgent string) *UserRemote {
+	if label == "" {
+		label = DeviceLabel(userAgent)
+	}
+	remote := UserRemote{
+		CredentialsUserID: c.UserID,
+		RemoteIP:          ipaddress,
+		Label:             label,
+		UserAgent:         userAgent,
+		Created:           time.Now(),
+		LastSeen:          time.Now(),
+	}
+	c.Remotes = append(c.Remotes, remote)
+	return &c.Remotes[len(c.Remotes)-1]
+}
+
+// TouchRemote function will update the last seen time of the remote address,
+// returning nil if the address isn't one of the user's remotes.
+func (c *Credentials) TouchRemote(ipaddress string) *UserRemote {
+	for i := range c.Remotes {
+		if c.Remotes[i].RemoteIP == ipaddress {
+			c.Remotes[i].LastSeen = time.Now()
+			return &c.Remotes[i]
+		}
+	}
+	return nil
+}
+
 // StartForgot function will be used to start the reset (forgot) password
 // process, creating a token and an expiration date/time.
 func (c *Credentials) StartForgot() string {
 	c.ResetToken = c.randomToken(8)
-	c.ResetExpires = time.Now().Add(time.Hour)
+	c.ResetExpires = time.Now().Add(ResetTokenLife)
+	c.ResetAttempts = 0
 	return c.ResetToken
 }
 
+// CanResendReset function will report if enough time has passed since the
+// last reset password token was sent to send another.  The token's sending
+// time is taken from its expiration.
+func (c *Credentials) CanResendReset() bool {
+	return c.ResetToken == "" ||
+		time.Until(c.ResetExpires) <= ResetTokenLife-ResetResendWait
+}
+
+// ResetPassword function will complete the reset (forgot) password process,
+// checking the token before setting the new password.
+func (c *Credentials) ResetPassword(token string, passwd string) (bool, *ErrorMessage) {
+	if ok, errMsg := c.CheckResetToken(token); !ok {
+		return false, errMsg
+	}
+	ok, errMsg := c.SetPassword(passwd)
+	if !ok {
+		return false, errMsg
+	}
+	c.ResetToken = ""
+	c.ResetExpires = time.Time{}
+	c.ResetAttempts = 0
+	return true, nil
+}
+
+// CheckResetToken function will check the reset (forgot) password token in
+// constant time and its expiration.  The token is removed after three
+// failures, so the process must be started again.
+func (c *Credentials) CheckResetToken(token string) (bool, *ErrorMessage) {
+	if c.ResetToken == "" || c.ResetExpires.Before(time.Now()) ||
+		subtle.ConstantTimeCompare([]byte(c.ResetToken), []byte(token)) != 1 {
+		return false, c.resetFailure("Invalid or expired reset token")
+	}
+	return true, nil
+}
+
+// resetFailure function will count a failed reset password attempt.
+func (c *Credentials) resetFailure(message string) *ErrorMessage {
+	c.ResetAttempts++
+	if c.ResetAttempts > 2 {
+		c.ResetToken = ""
+		c.ResetExpires = time.Time{}
+	}
+	return &ErrorMessage{
+		ErrorType:  "reset",
+		StatusCode: http.StatusUnauthorized,
+		Message:    message,
+	}
+}
+
 // CreateRandomPassword function will be used to create a temporary password
 // to provide to the employee for log in.  It will be passed to their email
 // address
@@ -246,6 +619,8 @@ func (c *Credentials) CreateRandomKey(length uint) string {
 func (c *Credentials) Unlock() bool {
 	c.BadAttempts = 0
 	c.Locked = false
+	c.LockedUntil = time.Time{}
+	c.LockCount = 0
 	return true
 }
 
@@ -259,76 +634,73 @@ func (c *Credentials) randomToken(size int) string {
 	return token
 }
 
-func (c *Credentials) CreateJWTToken(ID string, email string, editor bool,
-	key string) (string, *Token, error) {
+// CreateJWTToken function will create the user's access token, signed with
+// the current key from Keys, along with the token record used to revoke it.
+func (c *Credentials) CreateJWTToken(ID string, email string,
+	roles []string) (string, *Token, error) {
+	editor := false
+	for _, role := range roles {
+		editor = editor || role == RoleEditor
+	}
 	t := new(Token)
 	t.ID = uuid.NewString()
-	t.Expires = time.Now().Add(time.Hour * 3)
-	expiry := t.Expires.Unix()
+	t.UserID = ID
+	t.Issued = time.Now()
+	t.Expires = t.Issued.Add(AccessTokenLife)
 	claims := &JwtClaims{
 		Id:         ID,
 		Email:      email,
 		Editor:     editor,
-		Exp:        expiry,
+		Roles:      roles,
 		Expires:    c.Expires,
 		MustChange: c.MustChange,
 		Uuid:       t.ID,
 		Locked:     c.Locked,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expiry,
+		TwoFactor:  c.TOTPEnabled,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        t.ID,
+			Subject:   ID,
+			Issuer:    TokenIssuer,
+			Audience:  jwt.ClaimStrings{TokenAudience},
+			IssuedAt:  jwt.NewNumericDate(t.Issued),
+			NotBefore: jwt.NewNumericDate(t.Issued),
+			ExpiresAt: jwt.NewNumericDate(t.Expires),
 		},
 	}
-	secretKey := os.Getenv("JWT_SECRET")
-	if secretKey == "" {
-		err := godotenv.Load()
-		if err != nil {
-			return "", nil, err
-		}
-		secretKey = os.Getenv("JWT_SECRET")
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS384, claims)
-
-	signedToken, err := token.SignedString([]byte(secretKey))
+	signedToken, err := Keys.Sign(claims)
 	return signedToken, t, err
 }
 
-func (c *Credentials) ValidateToken(encodedToken string) (*jwt.Token, error) {
-	return jwt.Parse(encodedToken, func(token *jwt.Token) (interface{}, error) {
-		if _, isvalid := token.Method.(*jwt.SigningMethodHMAC); !isvalid {
-			return nil, fmt.Errorf("invalid token - %s", token.Header["alg"])
-		}
-		secretKey := os.Getenv("JWT_SECRET")
-		if secretKey == "" {
-			err := godotenv.Load()
-			if err != nil {
-				return nil, err
-			}
-			secretKey = os.Getenv("JWT_SECRET")
-		}
-		return []byte(secretKey), nil
-	})
-}
-
-func (c *Credentials) GetClaims(iClaims map[string]interface{}) *JwtClaims {
+// ValidateToken function will check the access token's signature with the
+// key from Keys it was signed with, then its expiration, not before time,
+// issuer and audience, providing the token's claims if it is valid.
+func (c *Credentials) ValidateToken(encodedToken string) (*JwtClaims,
+	*ErrorMessage) {
 	claims := new(JwtClaims)
-	for k, v := range iClaims {
-		switch strings.ToLower(k) {
-		case "id":
-			claims.Id = v.(string)
-		case "email":
-			claims.Email = v.(string)
-		case "editor":
-			claims.Editor = v.(bool)
-		case "expires":
-			claims.Expires, _ = time.Parse(time.RFC3339, v.(string))
-		case "mustchange":
-			claims.MustChange = v.(bool)
-		case "uuid":
-			claims.Uuid = v.(string)
-		case "locked":
-			claims.Locked = v.(bool)
+	token, err := Keys.Parse(encodedToken, claims)
+	if err == nil && !token.Valid {
+		err = errors.New("token not valid")
+	}
+	if err == nil && !claims.VerifyIssuer(TokenIssuer, true) {
+		err = fmt.Errorf("wrong issuer %q", claims.Issuer)
+	}
+	if err == nil && !claims.VerifyAudience(TokenAudience, true) {
+		err = fmt.Errorf("wrong audience %v", claims.Audience)
+	}
+	if err == nil && (claims.Id == "" || claims.Uuid == "") {
+		err = errors.New("missing user or token id")
+	}
+	if err != nil {
+		message := "Invalid Token"
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			message = "Token Expired"
+		}
+		return nil, &ErrorMessage{
+			ErrorType:  "token",
+			StatusCode: http.StatusUnauthorized,
+			Message:    message,
+			Details:    []string{err.Error()},
 		}
 	}
-	return claims
+	return claims, nil
 }
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResetResendWait(t *testing.T) {
+	creds := &Credentials{UserID: "user-1"}
+	if !creds.CanResendReset() {
+		t.Fatal("first reset token refused")
+	}
+	token := creds.StartForgot()
+	if creds.CanResendReset() {
+		t.Error("reset token sent again at once")
+	}
+	creds.ResetExpires = time.Now().Add(ResetTokenLife - ResetResendWait)
+	if !creds.CanResendReset() {
+		t.Error("reset token refused after the wait")
+	}
+	if ok, errMsg := creds.ResetPassword(token, "New Password 1"); !ok {
+		t.Fatal(errMsg.String())
+	}
+	if !creds.CanResendReset() {
+		t.Error("reset token refused after the reset")
+	}
+}
@@ -0,0 +1,540 @@
+package models
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	rd "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// WebAuthnRPID provides the relying party identifier passkeys are bound to,
+// which is the domain of the web site, WebAuthnOrigins the origins the
+// browser may report for the ceremonies, and WebAuthnChallengeLife how long
+// the client has to complete a ceremony.
+var (
+	WebAuthnRPID          = "localhost"
+	WebAuthnRPName        = "SOAP Journal"
+	WebAuthnOrigins       = []string{"http://localhost:8080"}
+	WebAuthnChallengeLife = time.Minute * 5
+)
+
+// The ceremonies a challenge is issued for, given as the type the browser
+// reports in the client data.
+const (
+	PasskeyRegistration = "webauthn.create"
+	PasskeyLogin        = "webauthn.get"
+)
+
+// The COSE algorithms accepted for passkeys.
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+// The authenticator data flags.
+const (
+	authFlagUserPresent  = 0x01
+	authFlagUserVerified = 0x04
+	authFlagAttested     = 0x40
+)
+
+// Base64URL is binary data given in JSON as unpadded base64url text, the
+// encoding used by the browser's WebAuthn JSON.
+type Base64URL []byte
+
+func (b Base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Base64URL) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+	value, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(text, "="))
+	if err != nil {
+		return err
+	}
+	*b = value
+	return nil
+}
+
+// WebAuthnCredential is a passkey registered by the user, keeping the COSE
+// public key used to check the passkey's signatures and the authenticator's
+// signature counter.
+type WebAuthnCredential struct {
+	ID                uint64    `json:"id" gorm:"primaryKey;column:id;autoIncrement"`
+	CredentialsUserID string    `json:"-" gorm:"column:userid;index"`
+	CredentialID      string    `json:"-" gorm:"column:credentialid;uniqueIndex"`
+	PublicKey         []byte    `json:"-" gorm:"column:publickey"`
+	Algorithm         int       `json:"algorithm" gorm:"column:algorithm"`
+	SignCount         uint32    `json:"-" gorm:"column:signcount"`
+	Label             string    `json:"label" gorm:"column:label"`
+	Created           time.Time `json:"created" gorm:"column:created"`
+	LastUsed          time.Time `json:"lastused" gorm:"column:lastused"`
+}
+
+func (WebAuthnCredential) TableName() string {
+	return "user_passkeys"
+}
+
+// WebAuthnChallenge is the random challenge issued for a single passkey
+// ceremony.  The user is empty for a login where the passkey will identify
+// the user.
+type WebAuthnChallenge struct {
+	ID        string    `json:"-" gorm:"primaryKey;column:id"`
+	UserID    string    `json:"-" gorm:"column:userid;index"`
+	Challenge string    `json:"-" gorm:"column:challenge"`
+	Ceremony  string    `json:"-" gorm:"column:ceremony"`
+	Expires   time.Time `json:"-" gorm:"column:expires"`
+}
+
+func (WebAuthnChallenge) TableName() string {
+	return "user_passkey_challenges"
+}
+
+// NewWebAuthnChallenge function will create the challenge for a ceremony,
+// which expires after WebAuthnChallengeLife.
+func NewWebAuthnChallenge(userID string, ceremony string) (*WebAuthnChallenge,
+	error) {
+	challenge := make([]byte, 32)
+	if _, err := rd.Read(challenge); err != nil {
+		return nil, err
+	}
+	return &WebAuthnChallenge{
+		ID:        uuid.NewString(),
+		UserID:    userID,
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		Ceremony:  ceremony,
+		Expires:   time.Now().Add(WebAuthnChallengeLife),
+	}, nil
+}
+
+type PublicKeyCredentialRP struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type PublicKeyCredentialUser struct {
+	ID          Base64URL `json:"id"`
+	Name        string    `json:"name"`
+	DisplayName string    `json:"displayName"`
+}
+
+type PublicKeyCredentialParam struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type PublicKeyCredentialDescriptor struct {
+	Type string    `json:"type"`
+	ID   Base64URL `json:"id"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CredentialCreationOptions provides the options the browser needs to create
+// a passkey, in the form of the WebAuthn PublicKeyCredentialCreationOptions.
+type CredentialCreationOptions struct {
+	RP                     PublicKeyCredentialRP           `json:"rp"`
+	User                   PublicKeyCredentialUser         `json:"user"`
+	Challenge              Base64URL                       `json:"challenge"`
+	PubKeyCredParams       []PublicKeyCredentialParam      `json:"pubKeyCredParams"`
+	Timeout                int64                           `json:"timeout"`
+	ExcludeCredentials     []PublicKeyCredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection          `json:"authenticatorSelection"`
+	Attestation            string                          `json:"attestation"`
+}
+
+// CredentialRequestOptions provides the options the browser needs to sign in
+// with a passkey, in the form of the WebAuthn
+// PublicKeyCredentialRequestOptions.
+type CredentialRequestOptions struct {
+	Challenge        Base64URL                       `json:"challenge"`
+	Timeout          int64                           `json:"timeout"`
+	RPID             string                          `json:"rpId"`
+	AllowCredentials []PublicKeyCredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                          `json:"userVerification"`
+}
+
+// AttestationResponse is the browser's response to the creation of a
+// passkey.
+type AttestationResponse struct {
+	ClientDataJSON    Base64URL `json:"clientDataJSON" binding:"required"`
+	AttestationObject Base64URL `json:"attestationObject" binding:"required"`
+}
+
+// AssertionResponse is the browser's response to a sign in with a passkey.
+type AssertionResponse struct {
+	ClientDataJSON    Base64URL `json:"clientDataJSON" binding:"required"`
+	AuthenticatorData Base64URL `json:"authenticatorData" binding:"required"`
+	Signature         Base64URL `json:"signature" binding:"required"`
+	UserHandle        Base64URL `json:"userHandle"`
+}
+
+// PasskeyCreationOptions function will provide the options for the user to
+// create a new passkey with the challenge.  The user's current passkeys are
+// excluded, so an authenticator isn't registered twice.
+func (u *User) PasskeyCreationOptions(
+	ch *WebAuthnChallenge) *CredentialCreationOptions {
+	challenge, _ := base64.RawURLEncoding.DecodeString(ch.Challenge)
+	return &CredentialCreationOptions{
+		RP: PublicKeyCredentialRP{
+			ID:   WebAuthnRPID,
+			Name: WebAuthnRPName,
+		},
+		User: PublicKeyCredentialUser{
+			ID:          Base64URL(u.ID),
+			Name:        u.Email,
+			DisplayName: u.Name.FullName(),
+		},
+		Challenge: challenge,
+		PubKeyCredParams: []PublicKeyCredentialParam{
+			{Type: "public-key", Alg: coseAlgES256},
+			{Type: "public-key", Alg: coseAlgEdDSA},
+			{Type: "public-key", Alg: coseAlgRS256},
+		},
+		Timeout:            WebAuthnChallengeLife.Milliseconds(),
+		ExcludeCredentials: passkeyDescriptors(u.Creds.Passkeys),
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: "required",
+		},
+		Attestation: "none",
+	}
+}
+
+// PasskeyRequestOptions function will provide the options to sign in with
+// one of the passkeys given, or with any passkey for the site if none are
+// given.
+func PasskeyRequestOptions(ch *WebAuthnChallenge,
+	passkeys []WebAuthnCredential) *CredentialRequestOptions {
+	challenge, _ := base64.RawURLEncoding.DecodeString(ch.Challenge)
+	return &CredentialRequestOptions{
+		Challenge:        challenge,
+		Timeout:          WebAuthnChallengeLife.Milliseconds(),
+		RPID:             WebAuthnRPID,
+		AllowCredentials: passkeyDescriptors(passkeys),
+		UserVerification: "required",
+	}
+}
+
+func passkeyDescriptors(
+	passkeys []WebAuthnCredential) []PublicKeyCredentialDescriptor {
+	descriptors := make([]PublicKeyCredentialDescriptor, 0)
+	for _, pk := range passkeys {
+		id, err := base64.RawURLEncoding.DecodeString(pk.CredentialID)
+		if err == nil {
+			descriptors = append(descriptors, PublicKeyCredentialDescriptor{
+				Type: "public-key",
+				ID:   id,
+			})
+		}
+	}
+	return descriptors
+}
+
+// FindPasskey function will provide the user's passkey with the credential
+// identifier, or nil if the user doesn't have it.
+func (c *Credentials) FindPasskey(credentialID string) *WebAuthnCredential {
+	for i := range c.Passkeys {
+		if c.Passkeys[i].CredentialID == credentialID {
+			return &c.Passkeys[i]
+		}
+	}
+	return nil
+}
+
+// AddPasskey function will complete the registration ceremony, checking the
+// browser's response against the challenge and adding the new passkey to the
+// user's credentials.  Attestation isn't requested, so the attestation
+// statement isn't checked.
+func (c *Credentials) AddPasskey(ch *WebAuthnChallenge,
+	resp *AttestationResponse, label string) (*WebAuthnCredential,
+	*ErrorMessage) {
+	if err := ch.checkClientData(resp.ClientDataJSON,
+		PasskeyRegistration); err != nil {
+		return nil, passkeyError(err)
+	}
+	item, _, err := decodeCBOR(resp.AttestationObject)
+	if err != nil {
+		return nil, passkeyError(err)
+	}
+	object, _ := item.(map[interface{}]interface{})
+	raw, _ := object["authData"].([]byte)
+	auth, err := parseAuthenticatorData(raw)
+	if err != nil {
+		return nil, passkeyError(err)
+	}
+	if auth.Flags&authFlagAttested == 0 {
+		return nil, passkeyError(errors.New("no credential data"))
+	}
+	alg, _, err := parseCOSEKey(auth.PublicKey)
+	if err != nil {
+		return nil, passkeyError(err)
+	}
+	credentialID := base64.RawURLEncoding.EncodeToString(auth.CredentialID)
+	if c.FindPasskey(credentialID) != nil {
+		return nil, &ErrorMessage{
+			ErrorType:  "passkey",
+			StatusCode: http.StatusConflict,
+			Message:    "Passkey already registered",
+		}
+	}
+	c.Passkeys = append(c.Passkeys, WebAuthnCredential{
+		CredentialsUserID: c.UserID,
+		CredentialID:      credentialID,
+		PublicKey:         auth.PublicKey,
+		Algorithm:         alg,
+		SignCount:         auth.SignCount,
+		Label:             label,
+		Created:           time.Now(),
+	})
+	return &c.Passkeys[len(c.Passkeys)-1], nil
+}
+
+// LogInPasskey function will check a sign in with one of the user's
+// passkeys, like LogIn does for the password.  The passkey is bound to the
+// device and the authenticator must have verified the user, by PIN or
+// biometrics, so the passkey is two factors itself and the password's
+// expiration, the new remote approval and the TOTP code aren't required.  A
+// passkey whose signature counter went backwards has been cloned and is
+// rejected.
+func (c *Credentials) LogInPasskey(ch *WebAuthnChallenge,
+	pk *WebAuthnCredential, resp *AssertionResponse) (bool, *ErrorMessage) {
+	if !c.IsVerified() {
+		return false, &ErrorMessage{
+			ErrorType:  "credentials",
+			StatusCode: 401,
+			Message:    "Account Not Verified",
+		}
+	}
+	if c.IsLocked() {
+		return false, c.lockedError()
+	}
+	auth, err := pk.verifyAssertion(ch, resp)
+	if err == nil && len(resp.UserHandle) > 0 &&
+		string(resp.UserHandle) != c.UserID {
+		err = errors.New("user handle mismatch")
+	}
+	if err != nil {
+		if c.recordFailure() {
+			return false, c.lockedError()
+		}
+		return false, passkeyError(err)
+	}
+	if (auth.SignCount != 0 || pk.SignCount != 0) &&
+		auth.SignCount <= pk.SignCount {
+		return false, passkeyError(errors.New("signature counter went back"))
+	}
+	if c.PendingApproval {
+		return false, &ErrorMessage{
+			ErrorType:  "credentials",
+			StatusCode: 401,
+			Message:    "Account Pending Approval",
+		}
+	}
+	pk.SignCount = auth.SignCount
+	pk.LastUsed = time.Now()
+	c.BadAttempts = 0
+	c.LockCount = 0
+	return true, nil
+}
+
+// verifyAssertion function will check the browser's response to a sign in
+// against the challenge and the passkey's public key.
+func (pk *WebAuthnCredential) verifyAssertion(ch *WebAuthnChallenge,
+	resp *AssertionResponse) (*authenticatorData, error) {
+	if err := ch.checkClientData(resp.ClientDataJSON, PasskeyLogin); err != nil {
+		return nil, err
+	}
+	auth, err := parseAuthenticatorData(resp.AuthenticatorData)
+	if err != nil {
+		return nil, err
+	}
+	_, key, err := parseCOSEKey(pk.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	clientHash := sha256.Sum256(resp.ClientDataJSON)
+	signed := append(append([]byte{}, resp.AuthenticatorData...),
+		clientHash[:]...)
+	digest := sha256.Sum256(signed)
+	valid := false
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		valid = ecdsa.VerifyASN1(k, digest[:], resp.Signature)
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(k, signed, resp.Signature)
+	case *rsa.PublicKey:
+		valid = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:],
+			resp.Signature) == nil
+	}
+	if !valid {
+		return nil, errors.New("invalid signature")
+	}
+	return auth, nil
+}
+
+// checkClientData function will check the client data the browser signed is
+// for the ceremony and challenge, and came from one of the site's origins.
+func (ch *WebAuthnChallenge) checkClientData(raw []byte,
+	ceremony string) error {
+	var client struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+	if err := json.Unmarshal(raw, &client); err != nil {
+		return err
+	}
+	if ch.Ceremony != ceremony || client.Type != ceremony {
+		return errors.New("wrong ceremony")
+	}
+	if ch.Expires.Before(time.Now()) {
+		return errors.New("challenge expired")
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimRight(client.Challenge, "=")),
+		[]byte(ch.Challenge)) != 1 {
+		return errors.New("wrong challenge")
+	}
+	for _, origin := range WebAuthnOrigins {
+		if client.Origin == origin {
+			return nil
+		}
+	}
+	return errors.New("wrong origin " + client.Origin)
+}
+
+// authenticatorData is the data signed by the authenticator, with the new
+// credential's identifier and public key when a passkey is created.
+type authenticatorData struct {
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// parseAuthenticatorData function will parse the authenticator data, which
+// must be for the site and have the user present and verified.
+func parseAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+	rpHash := sha256.Sum256([]byte(WebAuthnRPID))
+	if !bytes.Equal(raw[:32], rpHash[:]) {
+		return nil, errors.New("wrong relying party")
+	}
+	auth := &authenticatorData{
+		Flags:     raw[32],
+		SignCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+	if auth.Flags&authFlagUserPresent == 0 {
+		return nil, errors.New("user not present")
+	}
+	if auth.Flags&authFlagUserVerified == 0 {
+		return nil, errors.New("user not verified")
+	}
+	if auth.Flags&authFlagAttested == 0 {
+		return auth, nil
+	}
+	// the attested credential data is the authenticator's AAGUID, then the
+	// length of the credential identifier, the identifier and its COSE key.
+	rest := raw[37:]
+	if len(rest) < 18 {
+		return nil, errors.New("credential data too short")
+	}
+	size := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if size == 0 || len(rest) < size {
+		return nil, errors.New("credential data too short")
+	}
+	auth.CredentialID = rest[:size]
+	rest = rest[size:]
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, err
+	}
+	auth.PublicKey = rest[:len(rest)-len(after)]
+	return auth, nil
+}
+
+// parseCOSEKey function will provide the algorithm and public key of the COSE
+// key, which must be one of the accepted algorithms.
+func parseCOSEKey(raw []byte) (int, crypto.PublicKey, error) {
+	item, _, err := decodeCBOR(raw)
+	if err != nil {
+		return 0, nil, err
+	}
+	key, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return 0, nil, errors.New("invalid public key")
+	}
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+	crv, _ := key[int64(-1)].(int64)
+	switch {
+	case kty == 2 && alg == coseAlgES256 && crv == 1:
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if len(x) != 32 || len(y) != 32 {
+			return 0, nil, errors.New("invalid public key")
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return 0, nil, errors.New("invalid public key")
+		}
+		return coseAlgES256, pub, nil
+	case kty == 1 && alg == coseAlgEdDSA && crv == 6:
+		x, _ := key[int64(-2)].([]byte)
+		if len(x) != ed25519.PublicKeySize {
+			return 0, nil, errors.New("invalid public key")
+		}
+		return coseAlgEdDSA, ed25519.PublicKey(x), nil
+	case kty == 3 && alg == coseAlgRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return 0, nil, errors.New("invalid public key")
+		}
+		return coseAlgRS256, &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	}
+	return 0, nil, errors.New("unsupported public key algorithm")
+}
+
+// passkeyError function will provide the error message for a failed passkey
+// ceremony, with the reason it failed in the details.
+func passkeyError(err error) *ErrorMessage {
+	return &ErrorMessage{
+		ErrorType:  "passkey",
+		StatusCode: http.StatusUnauthorized,
+		Message:    "Passkey verification failed",
+		Details:    []string{err.Error()},
+	}
+}
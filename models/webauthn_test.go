@@ -0,0 +1,389 @@
+package models
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	rd "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// softAuthenticator is a software passkey authenticator, holding an ES256 or
+// Ed25519 key, used to run the ceremonies without a browser.
+type softAuthenticator struct {
+	alg   int
+	ec    *ecdsa.PrivateKey
+	ed    ed25519.PrivateKey
+	id    []byte
+	count uint32
+	flags byte
+}
+
+func newSoftAuthenticator(t *testing.T, alg int) *softAuthenticator {
+	t.Helper()
+	a := &softAuthenticator{
+		alg:   alg,
+		id:    make([]byte, 16),
+		flags: authFlagUserPresent | authFlagUserVerified,
+	}
+	rd.Read(a.id)
+	var err error
+	switch alg {
+	case coseAlgES256:
+		a.ec, err = ecdsa.GenerateKey(elliptic.P256(), rd.Reader)
+	case coseAlgEdDSA:
+		_, a.ed, err = ed25519.GenerateKey(rd.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	if a.alg == coseAlgEdDSA {
+		return cborEncode(map[int]interface{}{1: 1, 3: coseAlgEdDSA, -1: 6,
+			-2: []byte(a.ed.Public().(ed25519.PublicKey))})
+	}
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.ec.X.FillBytes(x)
+	a.ec.Y.FillBytes(y)
+	return cborEncode(map[int]interface{}{1: 2, 3: coseAlgES256, -1: 1,
+		-2: x, -3: y})
+}
+
+func (a *softAuthenticator) authData(attested bool) []byte {
+	rpHash := sha256.Sum256([]byte(WebAuthnRPID))
+	data := append([]byte{}, rpHash[:]...)
+	flags := a.flags
+	if attested {
+		flags |= authFlagAttested
+	}
+	data = append(data, flags)
+	data = append(data, bigEndian(uint64(a.count), 4)...)
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		data = append(data, bigEndian(uint64(len(a.id)), 2)...)
+		data = append(data, a.id...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+func (a *softAuthenticator) create(ch *WebAuthnChallenge,
+	origin string) *AttestationResponse {
+	return &AttestationResponse{
+		ClientDataJSON: clientData(PasskeyRegistration, ch.Challenge, origin),
+		AttestationObject: cborEncode(map[string]interface{}{
+			"fmt":      "none",
+			"attStmt":  map[string]interface{}{},
+			"authData": a.authData(true),
+		}),
+	}
+}
+
+func (a *softAuthenticator) get(t *testing.T, ch *WebAuthnChallenge,
+	origin string) *AssertionResponse {
+	t.Helper()
+	a.count++
+	resp := &AssertionResponse{
+		ClientDataJSON:    clientData(PasskeyLogin, ch.Challenge, origin),
+		AuthenticatorData: a.authData(false),
+	}
+	clientHash := sha256.Sum256(resp.ClientDataJSON)
+	signed := append(append([]byte{}, resp.AuthenticatorData...),
+		clientHash[:]...)
+	if a.alg == coseAlgEdDSA {
+		resp.Signature = ed25519.Sign(a.ed, signed)
+		return resp
+	}
+	digest := sha256.Sum256(signed)
+	sig, err := ecdsa.SignASN1(rd.Reader, a.ec, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Signature = sig
+	return resp
+}
+
+func bigEndian(n uint64, size int) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, n)
+	return data[8-size:]
+}
+
+func clientData(ceremony string, challenge string, origin string) []byte {
+	data, _ := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": challenge,
+		"origin":    origin,
+	})
+	return data
+}
+
+// cborEncode function will encode the subset of CBOR the authenticators use.
+func cborEncode(value interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 1<<8:
+			return []byte{major<<5 | 24, byte(n)}
+		case n < 1<<16:
+			return append([]byte{major<<5 | 25}, bigEndian(n, 2)...)
+		}
+		return append([]byte{major<<5 | 26}, bigEndian(n, 4)...)
+	}
+	switch v := value.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case map[int]interface{}:
+		keys := make([]int, 0)
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Ints(keys)
+		data := head(5, uint64(len(v)))
+		for _, k := range keys {
+			data = append(data, cborEncode(k)...)
+			data = append(data, cborEncode(v[k])...)
+		}
+		return data
+	case map[string]interface{}:
+		keys := make([]string, 0)
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		data := head(5, uint64(len(v)))
+		for _, k := range keys {
+			data = append(data, cborEncode(k)...)
+			data = append(data, cborEncode(v[k])...)
+		}
+		return data
+	}
+	panic("unsupported cbor value")
+}
+
+func passkeyUser() *Credentials {
+	return &Credentials{UserID: "user-1", Verified: time.Now()}
+}
+
+func challenge(t *testing.T, ceremony string) *WebAuthnChallenge {
+	t.Helper()
+	ch, err := NewWebAuthnChallenge("user-1", ceremony)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ch
+}
+
+func registerPasskey(t *testing.T, c *Credentials,
+	a *softAuthenticator) *WebAuthnCredential {
+	t.Helper()
+	ch := challenge(t, PasskeyRegistration)
+	pk, errMsg := c.AddPasskey(ch, a.create(ch, WebAuthnOrigins[0]), "test")
+	if errMsg != nil {
+		t.Fatalf("registration failed: %s %v", errMsg.String(), errMsg.Details)
+	}
+	return pk
+}
+
+func TestPasskeyCeremonies(t *testing.T) {
+	for _, alg := range []int{coseAlgES256, coseAlgEdDSA} {
+		a := newSoftAuthenticator(t, alg)
+		c := passkeyUser()
+		pk := registerPasskey(t, c, a)
+		if pk.Algorithm != alg ||
+			pk.CredentialID != base64.RawURLEncoding.EncodeToString(a.id) {
+			t.Fatalf("alg %d: passkey saved as %d %s", alg, pk.Algorithm,
+				pk.CredentialID)
+		}
+		for i := 0; i < 2; i++ {
+			ch := challenge(t, PasskeyLogin)
+			ok, errMsg := c.LogInPasskey(ch, pk, a.get(t, ch, WebAuthnOrigins[0]))
+			if !ok {
+				t.Fatalf("alg %d: login %d failed: %v", alg, i, errMsg.Details)
+			}
+		}
+		if pk.SignCount != a.count {
+			t.Errorf("alg %d: sign count %d, want %d", alg, pk.SignCount, a.count)
+		}
+
+		ch := challenge(t, PasskeyRegistration)
+		if _, errMsg := c.AddPasskey(ch, a.create(ch, WebAuthnOrigins[0]),
+			"again"); errMsg == nil || errMsg.StatusCode != 409 {
+			t.Errorf("alg %d: registered the same passkey twice", alg)
+		}
+	}
+}
+
+func TestPasskeyLoginFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(a *softAuthenticator, ch *WebAuthnChallenge,
+			pk *WebAuthnCredential, resp *AssertionResponse)
+		want string
+	}{
+		{"bad signature", func(a *softAuthenticator, ch *WebAuthnChallenge,
+			pk *WebAuthnCredential, resp *AssertionResponse) {
+			resp.Signature[len(resp.Signature)-1] ^= 0xff
+		}, "invalid signature"},
+		{"wrong origin", func(a *softAuthenticator, ch *WebAuthnChallenge,
+			pk *WebAuthnCredential, resp *AssertionResponse) {
+			resp.ClientDataJSON = clientData(PasskeyLogin, ch.Challenge,
+				"https://evil.example")
+		}, "wrong origin"},
+		{"wrong challenge", func(a *softAuthenticator, ch *WebAuthnChallenge,
+			pk *WebAuthnCredential, resp *AssertionResponse) {
+			ch.Challenge = strings.Repeat("A", len(ch.Challenge))
+		}, "wrong challenge"},
+		{"expired challenge", func(a *softAuthenticator, ch *WebAuthnChallenge,
+			pk *WebAuthnCredential, resp *AssertionResponse) {
+			ch.Expires = time.Now().Add(-time.Second)
+		}, "challenge expired"},
+		{"wrong ceremony", func(a *softAuthenticator, ch *WebAuthnChallenge,
+			pk *WebAuthnCredential, resp *AssertionResponse) {
+			ch.Ceremony = PasskeyRegistration
+		}, "wrong ceremony"},
+		{"counter regression", func(a *softAuthenticator, ch *WebAuthnChallenge,
+			pk *WebAuthnCredential, resp *AssertionResponse) {
+			pk.SignCount = a.count + 5
+		}, "signature counter went back"},
+		{"user handle", func(a *softAuthenticator, ch *WebAuthnChallenge,
+			pk *WebAuthnCredential, resp *AssertionResponse) {
+			resp.UserHandle = []byte("someone-else")
+		}, "user handle mismatch"},
+	}
+	for _, tt := range tests {
+		for _, alg := range []int{coseAlgES256, coseAlgEdDSA} {
+			a := newSoftAuthenticator(t, alg)
+			c := passkeyUser()
+			pk := registerPasskey(t, c, a)
+			ch := challenge(t, PasskeyLogin)
+			resp := a.get(t, ch, WebAuthnOrigins[0])
+			tt.change(a, ch, pk, resp)
+			ok, errMsg := c.LogInPasskey(ch, pk, resp)
+			if ok {
+				t.Errorf("%s (alg %d): login succeeded", tt.name, alg)
+				continue
+			}
+			if len(errMsg.Details) == 0 ||
+				!strings.HasPrefix(errMsg.Details[0], tt.want) {
+				t.Errorf("%s (alg %d): got %v, want %s", tt.name, alg,
+					errMsg.Details, tt.want)
+			}
+		}
+	}
+}
+
+func TestPasskeyRequiresUserVerification(t *testing.T) {
+	a := newSoftAuthenticator(t, coseAlgES256)
+	c := passkeyUser()
+	pk := registerPasskey(t, c, a)
+
+	// a security key that only checks presence can't stand in for the
+	// password and the second factor.
+	a.flags = authFlagUserPresent
+	ch := challenge(t, PasskeyLogin)
+	ok, errMsg := c.LogInPasskey(ch, pk, a.get(t, ch, WebAuthnOrigins[0]))
+	if ok || errMsg.Details[0] != "user not verified" {
+		t.Errorf("presence only login: %v %v", ok, errMsg)
+	}
+	ch = challenge(t, PasskeyRegistration)
+	a.id[0] ^= 0xff
+	if _, errMsg = c.AddPasskey(ch, a.create(ch, WebAuthnOrigins[0]),
+		"key"); errMsg == nil {
+		t.Error("presence only registration succeeded")
+	}
+}
+
+func TestPasskeyRegistrationFailures(t *testing.T) {
+	a := newSoftAuthenticator(t, coseAlgEdDSA)
+	c := passkeyUser()
+
+	ch := challenge(t, PasskeyRegistration)
+	if _, errMsg := c.AddPasskey(ch, a.create(ch, "https://evil.example"),
+		""); errMsg == nil {
+		t.Error("registration from another origin succeeded")
+	}
+	ch = challenge(t, PasskeyRegistration)
+	resp := a.create(ch, WebAuthnOrigins[0])
+	resp.AttestationObject = resp.AttestationObject[:len(resp.AttestationObject)/2]
+	if _, errMsg := c.AddPasskey(ch, resp, ""); errMsg == nil {
+		t.Error("registration with a truncated attestation succeeded")
+	}
+	if len(c.Passkeys) != 0 {
+		t.Errorf("failed registrations added %d passkeys", len(c.Passkeys))
+	}
+}
+
+func TestDecodeCBORMalformed(t *testing.T) {
+	deep := make([]byte, 0)
+	for i := 0; i < 20; i++ {
+		deep = append(deep, 0x81)
+	}
+	deep = append(deep, 0x00)
+	tests := map[string][]byte{
+		"empty":              {},
+		"truncated integer":  {0x19, 0x01},
+		"indefinite length":  {0x5f, 0x41, 0x00, 0xff},
+		"short byte string":  {0x44, 0x01, 0x02},
+		"short text string":  {0x63, 'a'},
+		"short array":        {0x82, 0x01},
+		"short map":          {0xa1, 0x01},
+		"array length":       {0x9a, 0xff, 0xff, 0xff, 0xff},
+		"map key type":       {0xa1, 0x41, 0x00, 0x01},
+		"float":              {0xfa, 0x00, 0x00, 0x00, 0x00},
+		"too deep":           deep,
+		"negative overflow":  {0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"unsigned overflow":  {0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"truncated tag item": {0xc6},
+	}
+	for name, data := range tests {
+		if _, _, err := decodeCBOR(data); err == nil {
+			t.Errorf("%s: decoded without an error", name)
+		}
+	}
+
+	item, rest, err := decodeCBOR(append(cborEncode(map[int]interface{}{
+		1: 2, -1: []byte{1, 2}, 3: "x"}), 0x01))
+	m, _ := item.(map[interface{}]interface{})
+	if err != nil || len(rest) != 1 || m[int64(1)] != int64(2) ||
+		m[int64(3)] != "x" {
+		t.Errorf("decoded %v %v %v", item, rest, err)
+	}
+}
+
+func TestParseCOSEKeyRejects(t *testing.T) {
+	a := newSoftAuthenticator(t, coseAlgES256)
+	x := make([]byte, 32)
+	a.ec.X.FillBytes(x)
+	tests := map[string][]byte{
+		"not a map":     cborEncode("key"),
+		"off curve":     cborEncode(map[int]interface{}{1: 2, 3: -7, -1: 1, -2: x, -3: x}),
+		"short ed25519": cborEncode(map[int]interface{}{1: 1, 3: -8, -1: 6, -2: []byte{1}}),
+		"unsupported":   cborEncode(map[int]interface{}{1: 2, 3: -35, -1: 2}),
+		"small rsa":     cborEncode(map[int]interface{}{1: 3, 3: -257, -1: make([]byte, 128), -2: []byte{1, 0, 1}}),
+	}
+	for name, raw := range tests {
+		if _, _, err := parseCOSEKey(raw); err == nil {
+			t.Errorf("%s: key accepted", name)
+		}
+	}
+}